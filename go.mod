@@ -6,6 +6,7 @@ require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05 // indirect
 	github.com/apex/log v1.9.0
 	github.com/dgraph-io/ristretto v0.0.3 // indirect
+	github.com/dustin/go-humanize v1.0.0
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/ipfs/go-cid v0.1.0
 	github.com/ipfs/go-datastore v0.4.6
@@ -13,21 +14,25 @@ require (
 	github.com/ipfs/go-filestore v0.0.3
 	github.com/ipfs/go-ipfs v0.10.0-rc1
 	github.com/ipfs/go-ipfs-config v0.16.0
+	github.com/ipfs/go-ipfs-ds-help v0.1.1
 	github.com/ipfs/go-ipfs-files v0.0.8
 	github.com/ipfs/go-ipfs-keystore v0.0.2
 	github.com/ipfs/go-log/v2 v2.3.0
 	github.com/ipfs/interface-go-ipfs-core v0.5.2
+	github.com/jbenet/goprocess v0.1.4
 	github.com/kr/text v0.2.0 // indirect
 	github.com/libp2p/go-libp2p v0.15.0 // indirect
 	github.com/libp2p/go-libp2p-core v0.10.0
 	github.com/libp2p/go-libp2p-swarm v0.6.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/multiformats/go-multiaddr v0.4.0
+	github.com/multiformats/go-multihash v0.0.15
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/afero v1.1.2
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/multierr v1.7.0
 	go.uber.org/zap v1.19.0
+	golang.org/x/crypto v0.0.0-20210813211128-0a44fdfbc16e
 )
 
 replace (
@@ -8,6 +8,7 @@ package atomicfile
 import (
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/spf13/afero"
 )
@@ -15,37 +16,191 @@ import (
 // File behaves like os.File, but does an atomic rename operation at Close.
 type File struct {
 	afero.File
-	fs   afero.Fs
-	path string
+	fs        afero.Fs
+	path      string
+	exclusive bool
+	opts      options
 }
 
+// Option configures a File.
+type Option func(*options)
+
+type options struct {
+	syncFile     bool
+	syncDir      bool
+	preserveMode bool
+}
+
+// SyncFile makes Close flush the temporary file to stable storage before the
+// rename, so the file can't be found empty or truncated after a power cut.
+func SyncFile() Option {
+	return func(o *options) { o.syncFile = true }
+}
+
+// SyncDir makes Close flush the parent directory to stable storage after the
+// rename, so the rename itself survives a power cut. It only applies to the
+// filesystems backed by the OS, such as an *afero.OsFs or an *afero.BasePathFs
+// over it, on unix systems.
+func SyncDir() Option {
+	return func(o *options) { o.syncDir = true }
+}
+
+// PreserveMode gives the file the mode of the file it replaces, if any,
+// instead of the mode passed to New. The ownership of the replaced file is
+// kept too on the filesystems backed by the OS on unix systems, when the
+// process may change it.
+func PreserveMode() Option {
+	return func(o *options) { o.preserveMode = true }
+}
+
+// RenameError is returned by Close when the temporary file can't be renamed
+// to the path of the file. Close removes the temporary file, named Temp.
+type RenameError struct {
+	Temp string
+	Path string
+	Err  error
+}
+
+func (e *RenameError) Error() string {
+	return "rename " + e.Temp + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *RenameError) Unwrap() error {
+	return e.Err
+}
+
+// exclusiveLock serializes the existence check and the rename of exclusive
+// files on the filesystems not backed by the OS, which can't link.
+var exclusiveLock sync.Mutex
+
 // New creates a new temporary file that will replace the file at the given
 // path when Closed.
-func New(fs afero.Fs, path string, mode os.FileMode) (*File, error) {
-	f, err := afero.TempFile(fs, filepath.Dir(path), filepath.Base(path))
+func New(fs afero.Fs, path string, mode os.FileMode, opts ...Option) (*File, error) {
+	return newFile(fs, path, filepath.Base(path), mode, false, opts)
+}
+
+// NewExclusive is like New, but Close fails with an error satisfying
+// os.IsExist, leaving the existing file untouched, if a file already exists
+// at path: it is the atomic counterpart of O_CREATE|O_EXCL. The temporary
+// file is hidden, so it can't be mistaken for the file being created.
+// PreserveMode doesn't apply. On the filesystems backed by the OS, such as an
+// *afero.OsFs or an *afero.BasePathFs over it, the file is linked to path so
+// even another process can't have created it in the meantime; on the others,
+// the guarantee only holds within the process.
+func NewExclusive(fs afero.Fs, path string, mode os.FileMode, opts ...Option) (*File, error) {
+	return newFile(fs, path, "."+filepath.Base(path), mode, true, opts)
+}
+
+func newFile(fs afero.Fs, path, prefix string, mode os.FileMode, exclusive bool, opts []Option) (*File, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var replaced os.FileInfo
+	if o.preserveMode && !exclusive {
+		st, err := fs.Stat(path)
+		if err == nil {
+			replaced = st
+			mode = st.Mode().Perm()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	f, err := afero.TempFile(fs, filepath.Dir(path), prefix)
 	if err != nil {
 		return nil, err
 	}
-	if err := fs.Chmod(f.Name(), mode); err != nil {
+	err = fs.Chmod(f.Name(), mode)
+	if err == nil && replaced != nil {
+		err = chown(f, replaced)
+	}
+	if err != nil {
 		f.Close()
 		fs.Remove(f.Name())
 		return nil, err
 	}
-	return &File{File: f, path: path, fs: fs}, nil
+	return &File{File: f, path: path, fs: fs, exclusive: exclusive, opts: o}, nil
 }
 
 // Close the file replacing the configured file.
 func (f *File) Close() error {
+	temp := f.File.Name()
+	if f.opts.syncFile {
+		if err := f.File.Sync(); err != nil {
+			f.File.Close()
+			f.fs.Remove(temp)
+			return err
+		}
+	}
 	if err := f.File.Close(); err != nil {
-		f.fs.Remove(f.File.Name())
+		f.fs.Remove(temp)
 		return err
 	}
-	if err := f.fs.Rename(f.Name(), f.path); err != nil {
-		return err
+
+	if f.exclusive {
+		if err := f.publish(); err != nil {
+			return err
+		}
+	} else if err := f.fs.Rename(temp, f.path); err != nil {
+		f.fs.Remove(temp)
+		return &RenameError{Temp: temp, Path: f.path, Err: err}
+	}
+
+	if f.opts.syncDir {
+		return FlushDir(f.fs, filepath.Dir(f.path))
 	}
 	return nil
 }
 
+// publish moves the closed temporary file of an exclusive file to its path,
+// removing it if the path already exists.
+func (f *File) publish() error {
+	if osf, ok := osFile(f.File); ok {
+		// unlike rename, link doesn't replace an existing file, even
+		// created by another process. The temporary file is in the
+		// directory of the file.
+		temp := osf.Name()
+		err := os.Link(temp, filepath.Join(filepath.Dir(temp), filepath.Base(f.path)))
+		if rmErr := f.fs.Remove(f.Name()); err == nil {
+			err = rmErr
+		}
+		return err
+	}
+
+	exclusiveLock.Lock()
+	defer exclusiveLock.Unlock()
+
+	_, err := f.fs.Stat(f.path)
+	switch {
+	case err == nil:
+		err = &os.PathError{Op: "rename", Path: f.path, Err: os.ErrExist}
+	case os.IsNotExist(err):
+		if err = f.fs.Rename(f.Name(), f.path); err == nil {
+			return nil
+		}
+	}
+	f.fs.Remove(f.Name())
+	return err
+}
+
+// osFile returns the *os.File behind f, if f was opened from a filesystem
+// backed by the OS: an *afero.OsFs, or an *afero.BasePathFs or
+// *afero.ReadOnlyFs over it.
+func osFile(f afero.File) (*os.File, bool) {
+	for {
+		switch v := f.(type) {
+		case *os.File:
+			return v, true
+		case *afero.BasePathFile:
+			f = v.File
+		default:
+			return nil, false
+		}
+	}
+}
+
 // Abort closes the file and removes it instead of replacing the configured
 // file. This is useful if after starting to write to the file you decide you
 // don't want it anymore.
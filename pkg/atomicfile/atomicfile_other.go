@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package atomicfile
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+func chown(afero.File, os.FileInfo) error {
+	return nil
+}
+
+// FlushDir is a no-op, directories can't be synced on all systems.
+func FlushDir(afero.Fs, string) error {
+	return nil
+}
@@ -2,7 +2,9 @@ package atomicfile_test
 
 import (
 	"bytes"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
@@ -88,3 +90,165 @@ func TestAbort(t *testing.T) {
 		t.Fatalf(`did not find expected "%s" instead found "%s"`, contents, actual)
 	}
 }
+
+func TestExclusive(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-exclusive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fss := []afero.Fs{afero.NewMemMapFs(), afero.NewOsFs(), afero.NewBasePathFs(afero.NewOsFs(), "/")}
+	for _, fs := range fss {
+		name := filepath.Join(dir, "file")
+
+		f, err := atomicfile.NewExclusive(fs, name, 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("first"))
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = atomicfile.NewExclusive(fs, name, 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("second"))
+		if err := f.Close(); !os.IsExist(err) {
+			t.Fatalf("expected an exist error, got %v", err)
+		}
+
+		actual, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != "first" {
+			t.Fatalf(`expected "first" instead found "%s"`, actual)
+		}
+		infos, err := afero.ReadDir(fs, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 {
+			t.Fatalf("expected the temporary files to be removed, found %d files", len(infos))
+		}
+		if err := fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncOptions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-sync-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fss := []afero.Fs{afero.NewMemMapFs(), afero.NewOsFs(), afero.NewBasePathFs(afero.NewOsFs(), "/")}
+	for _, fs := range fss {
+		name := filepath.Join(dir, "file")
+
+		f, err := atomicfile.New(fs, name, 0644, atomicfile.SyncFile(), atomicfile.SyncDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("synced"))
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != "synced" {
+			t.Fatalf(`expected "synced" instead found "%s"`, actual)
+		}
+	}
+}
+
+func TestPreserveMode(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-preserve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fs := range []afero.Fs{afero.NewMemMapFs(), afero.NewOsFs()} {
+		name := filepath.Join(dir, "file")
+
+		// the mode passed to New applies to a new file
+		f, err := atomicfile.New(fs, name, 0600, atomicfile.PreserveMode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Chmod(name, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = atomicfile.New(fs, name, 0600, atomicfile.PreserveMode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != 0640 {
+			t.Fatalf("expected mode 0640, found %o", st.Mode().Perm())
+		}
+		if err := fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenameError(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-rename-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := afero.NewOsFs()
+	name := filepath.Join(dir, "file")
+	// a file can't replace a non-empty directory
+	if err := fs.MkdirAll(filepath.Join(name, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := atomicfile.New(fs, name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("foo"))
+	err = f.Close()
+	var renameErr *atomicfile.RenameError
+	if !errors.As(err, &renameErr) {
+		t.Fatalf("expected a rename error, got %v", err)
+	}
+	if renameErr.Path != name {
+		t.Fatalf("expected the rename error of %s, got %s", name, renameErr.Path)
+	}
+	if _, err := fs.Stat(renameErr.Temp); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be removed, got %v", err)
+	}
+}
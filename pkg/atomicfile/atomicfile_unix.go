@@ -0,0 +1,54 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// chown gives the file f the ownership of the replaced file. Only root can
+// give away a file, so other users keep the ownership of the new file.
+func chown(f afero.File, replaced os.FileInfo) error {
+	osf, ok := osFile(f)
+	if !ok {
+		return nil
+	}
+	want, ok := replaced.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	info, err := osf.Stat()
+	if err != nil {
+		return err
+	}
+	if got, ok := info.Sys().(*syscall.Stat_t); ok && got.Uid == want.Uid && got.Gid == want.Gid {
+		return nil
+	}
+	err = osf.Chown(int(want.Uid), int(want.Gid))
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
+
+// FlushDir flushes the entries of the directory dir of fs to stable storage,
+// so the renames into it survive a power cut. It is a no-op unless fs is
+// backed by the OS, such as an *afero.OsFs or an *afero.BasePathFs over it.
+func FlushDir(fs afero.Fs, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := osFile(d); ok {
+		err = d.Sync()
+	}
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
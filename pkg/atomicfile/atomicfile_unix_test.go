@@ -0,0 +1,53 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package atomicfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	"github.com/spf13/afero"
+)
+
+func TestPreserveOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can give away a file")
+	}
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-ownership-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := os.WriteFile(name, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(name, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := atomicfile.New(afero.NewOsFs(), name, 0600, atomicfile.PreserveMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("bar"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := st.Sys().(*syscall.Stat_t)
+	if sys.Uid != 1 || sys.Gid != 1 {
+		t.Fatalf("expected the ownership to be preserved, found %d:%d", sys.Uid, sys.Gid)
+	}
+}
@@ -0,0 +1,194 @@
+package atomicfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// journalName is the name of the journal of a Group in its directory.
+	journalName = ".atomicfile-journal"
+	// stagedInfix is inserted in the names of the files staged by a Group.
+	stagedInfix = ".staged-"
+)
+
+// ErrGroupDone is returned when a Group is used after Commit or Abort.
+var ErrGroupDone = errors.New("group already committed or aborted")
+
+// Group stages several files of a directory and commits them together: either
+// none or all of them replace the existing files, even when the commit is
+// interrupted by a crash, once Recover ran on the directory. The commit is
+// recorded in a journal in the directory, so only one Group may commit in a
+// directory at a time.
+type Group struct {
+	fs     afero.Fs
+	dir    string
+	staged []journalEntry
+	done   bool
+}
+
+type journal struct {
+	Files []journalEntry
+}
+
+type journalEntry struct {
+	// Staged is the name of the staged file, renamed to Name on commit.
+	Staged string
+	Name   string
+}
+
+// NewGroup returns an empty group of files of dir.
+func NewGroup(fs afero.Fs, dir string) *Group {
+	return &Group{fs: fs, dir: dir}
+}
+
+// WriteFile stages data to be written with mode to the file name of the
+// directory of the group. The staged file is synced to stable storage.
+func (g *Group) WriteFile(name string, data []byte, mode os.FileMode) error {
+	if g.done {
+		return ErrGroupDone
+	}
+	if name != filepath.Base(name) {
+		return fmt.Errorf("%q is not a file name", name)
+	}
+
+	f, err := afero.TempFile(g.fs, g.dir, "."+name+stagedInfix)
+	if err != nil {
+		return err
+	}
+	staged := f.Name()
+	err = g.fs.Chmod(staged, mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		g.fs.Remove(staged)
+		return err
+	}
+
+	g.staged = append(g.staged, journalEntry{Staged: filepath.Base(staged), Name: name})
+	return nil
+}
+
+// Commit replaces the files of the directory with the staged files. Once the
+// journal is written, an error or a crash leaves the commit to Recover.
+func (g *Group) Commit() error {
+	if g.done {
+		return ErrGroupDone
+	}
+	if len(g.staged) == 0 {
+		g.done = true
+		return nil
+	}
+
+	j := journal{Files: g.staged}
+	buf, err := json.Marshal(j)
+	if err != nil {
+		g.Abort()
+		return err
+	}
+	f, err := NewExclusive(g.fs, filepath.Join(g.dir, journalName), 0600, SyncFile(), SyncDir())
+	if err != nil {
+		g.Abort()
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		g.Abort()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		g.Abort()
+		if os.IsExist(err) {
+			return fmt.Errorf("commit in %s: another commit is pending: %w", g.dir, err)
+		}
+		return err
+	}
+
+	// committed, the staged files now belong to the journal
+	g.done = true
+	g.staged = nil
+	return replay(g.fs, g.dir, j)
+}
+
+// Abort removes the staged files.
+func (g *Group) Abort() error {
+	if g.done {
+		return ErrGroupDone
+	}
+	g.done = true
+
+	var err error
+	for _, e := range g.staged {
+		if rerr := g.fs.Remove(filepath.Join(g.dir, e.Staged)); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	}
+	g.staged = nil
+	return err
+}
+
+// Pending reports whether dir holds the journal of a commit to recover.
+func Pending(fs afero.Fs, dir string) bool {
+	_, err := fs.Stat(filepath.Join(dir, journalName))
+	return err == nil
+}
+
+// Recover completes the commit of a Group in dir interrupted by a crash, if
+// any. It must not run concurrently with the commits in dir.
+func Recover(fs afero.Fs, dir string) error {
+	buf, err := afero.ReadFile(fs, filepath.Join(dir, journalName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var j journal
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return fmt.Errorf("invalid journal in %s: %v", dir, err)
+	}
+	return replay(fs, dir, j)
+}
+
+// replay renames the staged files of the journal, skipping the ones already
+// renamed, then removes the journal.
+func replay(fs afero.Fs, dir string, j journal) error {
+	for _, e := range j.Files {
+		staged, path := filepath.Join(dir, e.Staged), filepath.Join(dir, e.Name)
+		if err := fs.Rename(staged, path); err != nil && !os.IsNotExist(err) {
+			return &RenameError{Temp: staged, Path: path, Err: err}
+		}
+	}
+
+	// the renames must be durable before the journal is removed
+	if err := FlushDir(fs, dir); err != nil {
+		return err
+	}
+	if err := fs.Remove(filepath.Join(dir, journalName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return FlushDir(fs, dir)
+}
+
+// IsGroupTempFile reports whether name is a file staged by a Group, or the
+// temporary file of its journal. Those left by a crash before the commit can
+// be removed, when no Group is in use in their directory.
+func IsGroupTempFile(name string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.Contains(name, stagedInfix) || (strings.HasPrefix(name, "."+journalName) && len(name) > len(journalName)+1)
+}
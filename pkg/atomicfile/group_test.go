@@ -0,0 +1,161 @@
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	"github.com/spf13/afero"
+)
+
+func readDirNames(t *testing.T, fs afero.Fs, dir string) []string {
+	t.Helper()
+	infos, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names
+}
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/dir/a", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := atomicfile.NewGroup(fs, "/dir")
+	if err := g.WriteFile("a", []byte("new a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WriteFile("b", []byte("new b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WriteFile("sub/c", nil, 0644); err == nil {
+		t.Fatal("expected an error for a path")
+	}
+	// nothing is visible before the commit
+	if actual, _ := afero.ReadFile(fs, "/dir/a"); string(actual) != "old" {
+		t.Fatalf(`expected "old" instead found "%s"`, actual)
+	}
+	if exists, _ := afero.Exists(fs, "/dir/b"); exists {
+		t.Fatal("did not expect b to exist")
+	}
+
+	if err := g.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"a": "new a", "b": "new b"} {
+		actual, err := afero.ReadFile(fs, filepath.Join("/dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expected {
+			t.Fatalf(`expected "%s" instead found "%s"`, expected, actual)
+		}
+	}
+	if names := readDirNames(t, fs, "/dir"); len(names) != 2 {
+		t.Fatalf("expected the staged files and the journal to be removed, found %v", names)
+	}
+	if err := g.Commit(); err != atomicfile.ErrGroupDone {
+		t.Fatalf("expected ErrGroupDone, got %v", err)
+	}
+}
+
+func TestGroupAbort(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	g := atomicfile.NewGroup(fs, "/dir")
+	if err := g.WriteFile("a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names := readDirNames(t, fs, "/dir")
+	if len(names) != 1 || !atomicfile.IsGroupTempFile(names[0]) {
+		t.Fatalf("expected a staged file, found %v", names)
+	}
+
+	if err := g.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDirNames(t, fs, "/dir"); len(names) != 0 {
+		t.Fatalf("expected the staged files to be removed, found %v", names)
+	}
+	if atomicfile.IsGroupTempFile("a") || atomicfile.IsGroupTempFile(".a") {
+		t.Fatal("expected a regular file not to be a group temp file")
+	}
+}
+
+func TestGroupRecover(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "atomicfile-group-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := afero.NewOsFs()
+	// b can't replace a non-empty directory, interrupting the commit
+	if err := fs.MkdirAll(filepath.Join(dir, "b", "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	g := atomicfile.NewGroup(fs, dir)
+	if err := g.WriteFile("a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WriteFile("b", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = g.Commit()
+	var renameErr *atomicfile.RenameError
+	if !errors.As(err, &renameErr) {
+		t.Fatalf("expected a rename error, got %v", err)
+	}
+	if !atomicfile.Pending(fs, dir) {
+		t.Fatal("expected the commit to be pending")
+	}
+	// another commit must wait for the recovery
+	other := atomicfile.NewGroup(fs, dir)
+	if err := other.WriteFile("c", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Commit(); !os.IsExist(errors.Unwrap(err)) {
+		t.Fatalf("expected an exist error, got %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.Recover(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+	if atomicfile.Pending(fs, dir) {
+		t.Fatal("did not expect the commit to be pending")
+	}
+	for _, name := range []string{"a", "b"} {
+		actual, err := afero.ReadFile(fs, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != name {
+			t.Fatalf(`expected "%s" instead found "%s"`, name, actual)
+		}
+	}
+	if names := readDirNames(t, fs, dir); len(names) != 2 {
+		t.Fatalf("expected the staged files and the journal to be removed, found %v", names)
+	}
+
+	// nothing to recover
+	if err := atomicfile.Recover(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+}
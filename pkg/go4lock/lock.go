@@ -47,6 +47,13 @@ import (
 // On other operating systems, lock will fallback to using the presence and
 // content of a file named name + '.lock' to implement locking behavior.
 func Lock(fs afero.Fs, name string) (io.Closer, error) {
+	return LockWithMeta(fs, name, nil)
+}
+
+// LockWithMeta is like Lock, but writes meta in the lock file instead of the
+// bare PID of the owner. meta must encode to a JSON object with the PID of
+// the owner in its OwnerPID field.
+func LockWithMeta(fs afero.Fs, name string, meta interface{}) (io.Closer, error) {
 	abs := name
 	lockmu.Lock()
 	defer lockmu.Unlock()
@@ -54,19 +61,27 @@ func Lock(fs afero.Fs, name string) (io.Closer, error) {
 		return nil, fmt.Errorf("file %q already locked by us", abs)
 	}
 
-	c, err := lockFn(fs, abs)
+	c, err := lockFn(fs, abs, meta)
 	if err != nil {
-		return nil, fmt.Errorf("cannot acquire lock: %v", err)
+		return nil, fmt.Errorf("cannot acquire lock: %w", err)
 	}
 	locked[abs] = true
 	return c, nil
 }
 
-var lockFn = lockPortable
+var lockFn = lockPortableMeta
 
 // lockPortable is a portable version not using fcntl. Doesn't handle crashes as gracefully,
 // since it can leave stale lock files.
 func lockPortable(fs afero.Fs, name string) (io.Closer, error) {
+	return lockPortableMeta(fs, name, nil)
+}
+
+func lockPortableMeta(fs afero.Fs, name string, meta interface{}) (io.Closer, error) {
+	if meta == nil {
+		meta = &pidLockMeta{OwnerPID: os.Getpid()}
+	}
+
 	/*lf, err := os.CreateTemp("", "testlog")
 	if err != nil {
 		return nil, errors.Wrap(err, "open log file")
@@ -93,10 +108,10 @@ func lockPortable(fs afero.Fs, name string) (io.Closer, error) {
 	}
 	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create lock file %s %v", name, err)
+		return nil, fmt.Errorf("failed to create lock file %s %w", name, err)
 	}
 	//fmt.Println("created file", name)
-	if err := json.NewEncoder(f).Encode(&pidLockMeta{OwnerPID: os.Getpid()}); err != nil {
+	if err := json.NewEncoder(f).Encode(meta); err != nil {
 		return nil, fmt.Errorf("cannot write owner pid: %v", err)
 	}
 	return &unlocker{
@@ -135,29 +150,54 @@ func portableLockStatus(l *zap.Logger, fs afero.Fs, path string) lockStatus {
 	if meta.OwnerPID == 0 {
 		return statusInvalid
 	}
-	p, err := os.FindProcess(meta.OwnerPID)
+	l.Debug("sending signal")
+	running, ok := Running(meta.OwnerPID)
+	switch {
+	case !ok:
+		l.Debug("already locked")
+		return statusLocked
+	case running:
+		return statusLockedByOther
+	default:
+		return statusStale
+	}
+}
+
+var signalZero os.Signal // nil or set by lock_sigzero.go
+
+// Running reports whether the process pid is running on this host. ok is
+// false when it can't be told on this platform.
+func Running(pid int) (running, ok bool) {
+	p, err := os.FindProcess(pid)
 	if err != nil {
 		// e.g. on Windows
-		return statusStale
+		return false, true
 	}
 	// On unix, os.FindProcess always is true, so we have to send
 	// it a signal to see if it's alive.
+	if signalZero == nil {
+		return false, false
+	}
+	return p.Signal(signalZero) == nil, true
+}
 
-	l.Debug("sending signal")
-	if signalZero != nil {
-		if p.Signal(signalZero) != nil {
-			return statusStale
-		} else {
-			return statusLockedByOther
-		}
+// Stale reports whether the lock file name would prevent taking the lock
+// while no process holds it, because its owner is not running anymore or its
+// content is invalid. An empty lock file is not stale, its owner may not have
+// written it yet.
+func Stale(fs afero.Fs, name string) bool {
+	fi, err := fs.Stat(name)
+	if err != nil || fi.Size() == 0 {
+		return false
 	}
 
-	l.Debug("already locked")
-	return statusLocked
+	switch portableLockStatus(zap.NewNop(), fs, name) {
+	case statusStale, statusInvalid:
+		return true
+	}
+	return false
 }
 
-var signalZero os.Signal // nil or set by lock_sigzero.go
-
 var (
 	lockmu sync.Mutex
 	locked = map[string]bool{} // abs path -> true
@@ -23,17 +23,25 @@ func (e LockedError) Error() string {
 	return string(e)
 }
 
-// Lock creates the lock.
+// Lock creates the lock. Its lock file records the Owner of the lock.
 func Lock(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
 	lockFilePath := filepath.Join(confdir, lockFileName)
-	lk, err := lock.Lock(fs, lockFilePath)
+	owner, err := newOwner(confdir)
+	if err != nil {
+		return nil, err
+	}
+	lk, err := lock.LockWithMeta(fs, lockFilePath, owner)
 	if err != nil {
 		switch {
 		case strings.Contains(err.Error(), "locked by other"):
+			reason := "someone else has the lock"
+			if info, err := Inspect(fs, confdir, lockFileName); err == nil && info.Owner.PID != 0 {
+				reason += ": " + info.Owner.String()
+			}
 			return lk, &os.PathError{
 				Op:   "lock",
 				Path: lockFilePath,
-				Err:  LockedError("someone else has the lock"),
+				Err:  LockedError(reason),
 			}
 		case strings.Contains(err.Error(), "already locked"):
 			// we hold the lock ourselves
@@ -42,7 +50,7 @@ func Lock(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
 				Path: lockFilePath,
 				Err:  LockedError("lock is already held by us"),
 			}
-		case os.IsPermission(err) || isLockCreatePermFail(err):
+		case errors.Is(err, os.ErrPermission) || isLockCreatePermFail(err):
 			// lock fails on permissions error
 
 			// Using a path error like this ensures that
@@ -66,6 +74,16 @@ func FileExists(fs afero.Fs, filename string) bool {
 	return false
 }
 
+// Stale checks if there is a lock file left by a process which is gone, or
+// holding an expired lease.
+func Stale(fs afero.Fs, confdir, lockFile string) bool {
+	path := filepath.Join(confdir, lockFile)
+	if lease, err := ReadLease(fs, path); err == nil {
+		return lease.Expired()
+	}
+	return lock.Stale(fs, path)
+}
+
 // Locked checks if there is a lock already set.
 func Locked(fs afero.Fs, confdir, lockFile string) (bool, error) {
 	log.Debugf("Checking lock")
@@ -0,0 +1,258 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// DefaultLeaseTTL is the duration of a lease when LeaseLocker.TTL is zero.
+const DefaultLeaseTTL = 30 * time.Second
+
+// lockWaitInterval is the delay between the attempts of LockWait.
+const lockWaitInterval = 100 * time.Millisecond
+
+// LeaseLocker is a lock whose lock file holds a lease: the owner of the lock,
+// including its hostname, and the expiry of the lease. The lease is renewed by the holder
+// in a goroutine until the lock is closed, and a lock whose lease expired,
+// because its holder crashed or can't reach the filesystem anymore, can be
+// taken over. Unlike PIDFileLocker it doesn't rely on PIDs, so it works for
+// filesystems shared across PID namespaces or hosts, as long as their clocks
+// are synchronized well within the TTL.
+type LeaseLocker struct {
+	// TTL is the duration of a lease, DefaultLeaseTTL when zero.
+	TTL time.Duration
+	// RenewInterval is the delay between the renewals of the lease, a third
+	// of the TTL when zero.
+	RenewInterval time.Duration
+	// ID identifies the holder of the lock, a random ID when empty.
+	ID string
+}
+
+var _ Locker = LeaseLocker{}
+
+// errNoLease is wrapped by the errors of the lock files which don't hold a
+// lease.
+var errNoLease = errors.New("lock file doesn't hold a lease")
+
+// Lease is the content of the lock file of a LeaseLocker.
+type Lease struct {
+	Owner
+	Expires time.Time
+}
+
+// Expired returns whether the lease can be taken over.
+func (l Lease) Expired() bool {
+	return time.Now().After(l.Expires)
+}
+
+func (l LeaseLocker) ttl() time.Duration {
+	if l.TTL == 0 {
+		return DefaultLeaseTTL
+	}
+	return l.TTL
+}
+
+func (l LeaseLocker) renewInterval() time.Duration {
+	if l.RenewInterval == 0 {
+		return l.ttl() / 3
+	}
+	return l.RenewInterval
+}
+
+// Lock takes the lock if it is free or its lease expired.
+func (l LeaseLocker) Lock(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	path := filepath.Join(confdir, lockFileName)
+
+	owner, err := newOwner(confdir)
+	if err != nil {
+		return nil, err
+	}
+	if l.ID != "" {
+		owner.ID = l.ID
+	}
+	lease := Lease{Owner: owner}
+
+	current, err := ReadLease(fs, path)
+	switch {
+	case os.IsNotExist(err):
+	case errors.Is(err, errNoLease) || errors.Is(err, errInvalidLockFile):
+		// held with another locker, or being created
+		return nil, lockedError(path, err.Error())
+	case err != nil:
+		return nil, err
+	case !current.Expired():
+		return nil, lockedError(path, fmt.Sprintf("leased by %s until %s", current.Owner, current.Expires.Format(time.RFC3339)))
+	default:
+		if err := takeOver(fs, path, current); err != nil {
+			return nil, err
+		}
+	}
+
+	lease.Expires = time.Now().Add(l.ttl())
+	f, err := atomicfile.NewExclusive(fs, path, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(f).Encode(&lease); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		if os.IsExist(err) {
+			return nil, lockedError(path, "someone else took the lock")
+		}
+		return nil, err
+	}
+
+	u := &leaseUnlocker{
+		fs:    fs,
+		path:  path,
+		lease: lease,
+		ttl:   l.ttl(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go u.renew(l.renewInterval())
+	return u, nil
+}
+
+// takeOver removes the lock file holding the expired lease, failing if
+// another contender took over first or the lease was renewed meanwhile.
+func takeOver(fs afero.Fs, path string, expired Lease) error {
+	err := removeLockFile(fs, path, func(lease Lease) bool {
+		return lease == expired
+	})
+	if os.IsNotExist(err) {
+		return lockedError(path, "someone else took the lock")
+	}
+	return err
+}
+
+// ReadLease reads the lease of the lock file at path.
+func ReadLease(fs afero.Fs, path string) (Lease, error) {
+	lease, err := readLockFile(fs, path)
+	if err != nil {
+		return Lease{}, err
+	}
+	if lease.ID == "" || lease.Expires.IsZero() {
+		return Lease{}, fmt.Errorf("%q: %w", path, errNoLease)
+	}
+	return lease, nil
+}
+
+type leaseUnlocker struct {
+	fs    afero.Fs
+	path  string
+	lease Lease
+	ttl   time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func (u *leaseUnlocker) renew(interval time.Duration) {
+	defer close(u.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := u.renewOnce(); err != nil {
+			log.Errorf("failed to renew the lease of %s: %v", u.path, err)
+			if errors.As(err, new(LockedError)) {
+				return
+			}
+		}
+	}
+}
+
+// renewOnce replaces the lease with a renewed one. The lease is moved away
+// before being replaced, so a lease taken over meanwhile is never overwritten.
+func (u *leaseUnlocker) renewOnce() error {
+	lease := u.lease
+	lease.Expires = time.Now().Add(u.ttl)
+	f, err := atomicfile.NewExclusive(u.fs, u.path, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(&lease); err != nil {
+		f.Abort()
+		return err
+	}
+
+	err = removeLockFile(u.fs, u.path, func(current Lease) bool {
+		return current.ID == u.lease.ID
+	})
+	if os.IsNotExist(err) {
+		err = lockedError(u.path, "lease lost")
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		if os.IsExist(err) {
+			return lockedError(u.path, "someone else took the lock")
+		}
+		return err
+	}
+	return nil
+}
+
+func (u *leaseUnlocker) Close() error {
+	u.once.Do(func() {
+		close(u.stop)
+		<-u.done
+
+		// the lease may have expired and been taken over
+		current, err := ReadLease(u.fs, u.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				u.err = err
+			}
+			return
+		}
+		if current.ID == u.lease.ID {
+			u.err = u.fs.Remove(u.path)
+		}
+	})
+	return u.err
+}
+
+// LockWait takes the lock with locker, retrying while it is taken by someone
+// else until it is acquired or ctx is done.
+func LockWait(ctx context.Context, locker Locker, fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	ticker := time.NewTicker(lockWaitInterval)
+	defer ticker.Stop()
+
+	for {
+		lk, err := locker.Lock(fs, confdir, lockFileName)
+		if err == nil || !errors.As(err, new(LockedError)) {
+			return lk, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
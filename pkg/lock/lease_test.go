@@ -0,0 +1,113 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseLocker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := filepath.Join("/repo", "test.lock")
+	locker := LeaseLocker{TTL: time.Second, RenewInterval: 50 * time.Millisecond, ID: "a"}
+
+	testLocker(t, locker, fs, "/repo")
+
+	lk, err := locker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	lease, err := ReadLease(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, "a", lease.ID)
+	require.NotEmpty(t, lease.Hostname)
+	require.False(t, Stale(fs, "/repo", "test.lock"))
+
+	// the lease is renewed past its TTL
+	time.Sleep(1200 * time.Millisecond)
+	_, err = LeaseLocker{ID: "b"}.Lock(fs, "/repo", "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	renewed, err := ReadLease(fs, path)
+	require.NoError(t, err)
+	require.True(t, renewed.Expires.After(lease.Expires))
+
+	require.NoError(t, lk.Close())
+	require.False(t, FileExists(fs, path))
+}
+
+func TestLeaseLockerTakeOver(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := filepath.Join("/repo", "test.lock")
+
+	// the lease of a crashed holder
+	buf, err := json.Marshal(Lease{Owner: Owner{ID: "crashed", Hostname: "elsewhere"}, Expires: time.Now().Add(-time.Second)})
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, path, buf, 0644))
+	require.True(t, Stale(fs, "/repo", "test.lock"))
+
+	lk, err := LeaseLocker{ID: "b"}.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	lease, err := ReadLease(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, "b", lease.ID)
+
+	// the previous holder doesn't remove the lock of the new one
+	stolen, err := LeaseLocker{ID: "c"}.Lock(fs, "/repo", "other.lock")
+	require.NoError(t, err)
+	buf, err = json.Marshal(Lease{Owner: Owner{ID: "d", Hostname: "elsewhere"}, Expires: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, filepath.Join("/repo", "other.lock"), buf, 0644))
+	// nor renews over it
+	err = stolen.(*leaseUnlocker).renewOnce()
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	lease, err = ReadLease(fs, filepath.Join("/repo", "other.lock"))
+	require.NoError(t, err)
+	require.Equal(t, "d", lease.ID)
+	require.NoError(t, stolen.Close())
+	require.True(t, FileExists(fs, filepath.Join("/repo", "other.lock")))
+
+	require.NoError(t, lk.Close())
+}
+
+func TestLockWait(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	lk, err := MutexLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*lockWaitInterval)
+	defer cancel()
+	_, err = LockWait(ctx, MutexLocker, fs, "/repo", "test.lock")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(2 * lockWaitInterval)
+		lk.Close()
+	}()
+	lk, err = LockWait(context.Background(), MutexLocker, fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+}
+
+func TestLeaseLockerWaitOtherLocker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	// a lock file without lease is held with another locker
+	lk, err := PIDFileLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	locker := LeaseLocker{ID: "a"}
+	_, err = locker.Lock(fs, "/repo", "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+
+	go func() {
+		time.Sleep(2 * lockWaitInterval)
+		lk.Close()
+	}()
+	lk, err = LockWait(context.Background(), locker, fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+}
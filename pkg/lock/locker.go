@@ -0,0 +1,110 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// Locker takes the lock named lockFileName in the directory confdir of fs.
+// When the lock is already taken, the returned error wraps a LockedError.
+type Locker interface {
+	Lock(fs afero.Fs, confdir, lockFileName string) (io.Closer, error)
+}
+
+// LockerFunc is a function implementing Locker.
+type LockerFunc func(fs afero.Fs, confdir, lockFileName string) (io.Closer, error)
+
+func (f LockerFunc) Lock(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	return f(fs, confdir, lockFileName)
+}
+
+var (
+	// PIDFileLocker is the portable lock of Lock, a lock file holding the
+	// PID of its owner. A lock left by a crashed process is taken over.
+	PIDFileLocker Locker = LockerFunc(Lock)
+
+	// OSLocker is an OS advisory lock (flock) of the lock file, released by
+	// the OS when the process exits. It requires an *afero.OsFs and is not
+	// supported on all platforms.
+	OSLocker Locker = LockerFunc(lockOS)
+
+	// MutexLocker is an in-process lock, for the filesystems only used by the
+	// current process such as an *afero.MemMapFs. It doesn't create a file.
+	MutexLocker Locker = LockerFunc(lockMutex)
+
+	// NopLocker doesn't lock anything, for read-only uses.
+	NopLocker Locker = LockerFunc(lockNop)
+)
+
+// ErrUnsupportedFs is returned by OSLocker for a filesystem not backed by the
+// OS.
+var ErrUnsupportedFs = errors.New("filesystem doesn't support OS locks")
+
+func lockedError(path, reason string) error {
+	return &os.PathError{
+		Op:   "lock",
+		Path: path,
+		Err:  LockedError(reason),
+	}
+}
+
+// writeOwner writes the owner of an OS lock file, in the format of
+// PIDFileLocker, so both lockers exclude each other.
+func writeOwner(f afero.File, owner Owner) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(owner)
+}
+
+type mutexKey struct {
+	fs   afero.Fs
+	path string
+}
+
+var (
+	mutexLocksMu sync.Mutex
+	mutexLocks   = map[mutexKey]bool{}
+)
+
+type mutexUnlocker struct {
+	key  mutexKey
+	once sync.Once
+}
+
+func (u *mutexUnlocker) Close() error {
+	u.once.Do(func() {
+		mutexLocksMu.Lock()
+		delete(mutexLocks, u.key)
+		mutexLocksMu.Unlock()
+	})
+	return nil
+}
+
+func lockMutex(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	key := mutexKey{fs, filepath.Join(confdir, lockFileName)}
+
+	mutexLocksMu.Lock()
+	defer mutexLocksMu.Unlock()
+	if mutexLocks[key] {
+		return nil, lockedError(key.path, "lock is already held by us")
+	}
+	mutexLocks[key] = true
+	return &mutexUnlocker{key: key}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func lockNop(afero.Fs, string, string) (io.Closer, error) {
+	return nopCloser{}, nil
+}
@@ -0,0 +1,106 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package lock
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+type flockUnlocker struct {
+	fs   afero.Fs
+	f    *os.File
+	once sync.Once
+	err  error
+}
+
+func (u *flockUnlocker) Close() error {
+	u.once.Do(func() {
+		// removed while still locked, so a waiting locker can't lock the
+		// removed file, see lockOS
+		u.err = u.fs.Remove(u.f.Name())
+		if err := u.f.Close(); u.err == nil {
+			u.err = err
+		}
+	})
+	return u.err
+}
+
+func lockOS(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	if _, ok := fs.(*afero.OsFs); !ok {
+		return nil, ErrUnsupportedFs
+	}
+	path := filepath.Join(confdir, lockFileName)
+	owner, err := newOwner(confdir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				reason := "someone else has the lock"
+				if info, err := Inspect(fs, confdir, lockFileName); err == nil && info.Owner.PID != 0 {
+					reason += ": " + info.Owner.String()
+				}
+				return nil, lockedError(path, reason)
+			}
+			return nil, &os.PathError{Op: "lock", Path: path, Err: err}
+		}
+
+		// the file may have been removed by its previous owner between
+		// the open and the lock
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			// the lock file may be held by a PIDFileLocker or a LeaseLocker,
+			// which don't flock it
+			if err := checkPreviousOwner(fs, path); err != nil {
+				f.Close()
+				return nil, err
+			}
+			if err := writeOwner(f, owner); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return &flockUnlocker{fs: fs, f: f}, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// checkPreviousOwner fails with a LockedError unless the owner recorded in the
+// lock file at path, if any, is gone.
+func checkPreviousOwner(fs afero.Fs, path string) error {
+	lf, err := readLockFile(fs, path)
+	if err != nil {
+		return lockedError(path, err.Error())
+	}
+	if lf.Owner == (Owner{}) && lf.Expires.IsZero() {
+		// just created
+		return nil
+	}
+	if liveness(lf) == Alive {
+		return lockedError(path, "someone else has the lock: "+lf.Owner.String())
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package lock
+
+import (
+	"io"
+
+	"github.com/spf13/afero"
+)
+
+func lockOS(afero.Fs, string, string) (io.Closer, error) {
+	return nil, ErrUnsupportedFs
+}
@@ -0,0 +1,96 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func testLocker(t *testing.T, locker Locker, fs afero.Fs, confdir string) {
+	t.Helper()
+
+	lk, err := locker.Lock(fs, confdir, "test.lock")
+	require.NoError(t, err)
+
+	_, err = locker.Lock(fs, confdir, "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	// other locks are independent
+	other, err := locker.Lock(fs, confdir, "other.lock")
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	require.NoError(t, lk.Close())
+	require.NoError(t, lk.Close(), "close must be idempotent")
+
+	lk, err = locker.Lock(fs, confdir, "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+}
+
+func TestMutexLocker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testLocker(t, MutexLocker, fs, "/repo")
+
+	// locks are per filesystem
+	lk, err := MutexLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	defer lk.Close()
+	other, err := MutexLocker.Lock(afero.NewMemMapFs(), "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+}
+
+func TestNopLocker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for i := 0; i < 2; i++ {
+		lk, err := NopLocker.Lock(fs, "/repo", "test.lock")
+		require.NoError(t, err)
+		defer lk.Close()
+	}
+}
+
+func TestOSLocker(t *testing.T) {
+	_, err := OSLocker.Lock(afero.NewMemMapFs(), "/repo", "test.lock")
+	if err != ErrUnsupportedFs {
+		t.Fatalf("expected ErrUnsupportedFs, got %v", err)
+	}
+
+	confdir, err := os.MkdirTemp("", "oslocker")
+	require.NoError(t, err)
+	defer os.RemoveAll(confdir)
+	fs := afero.NewOsFs()
+
+	lk, err := OSLocker.Lock(fs, confdir, "test.lock")
+	if err == ErrUnsupportedFs {
+		t.Skip("OS locks are not supported on this platform")
+	}
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+
+	testLocker(t, OSLocker, fs, confdir)
+
+	// the lockers exclude each other
+	lk, err = OSLocker.Lock(fs, confdir, "test.lock")
+	require.NoError(t, err)
+	_, err = PIDFileLocker.Lock(fs, confdir, "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	require.False(t, Stale(fs, confdir, "test.lock"))
+	require.NoError(t, lk.Close())
+	assertLock(t, fs, confdir, "test.lock", false)
+
+	// the lock file of a live PIDFileLocker holder is left untouched
+	lk, err = PIDFileLocker.Lock(fs, confdir, "test.lock")
+	require.NoError(t, err)
+	held, err := afero.ReadFile(fs, filepath.Join(confdir, "test.lock"))
+	require.NoError(t, err)
+	_, err = OSLocker.Lock(fs, confdir, "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	buf, err := afero.ReadFile(fs, filepath.Join(confdir, "test.lock"))
+	require.NoError(t, err)
+	require.Equal(t, held, buf)
+	require.NoError(t, lk.Close())
+}
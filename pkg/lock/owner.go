@@ -0,0 +1,223 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	lock "github.com/berty/go-ipfs-repo-afero/pkg/go4lock"
+	"github.com/spf13/afero"
+)
+
+// ErrOwnerChanged is returned by Break when the lock is not held by the
+// expected owner anymore.
+var ErrOwnerChanged = errors.New("lock owner changed")
+
+// errInvalidLockFile is wrapped by the errors of the lock files which can't be
+// decoded.
+var errInvalidLockFile = errors.New("invalid lock file")
+
+// processStart approximates the start time of the process.
+var processStart = time.Now().UTC()
+
+// Owner describes the holder of a lock. It is recorded in the lock files of
+// PIDFileLocker, OSLocker and LeaseLocker.
+type Owner struct {
+	// ID is unique to each acquisition of the lock.
+	ID       string
+	PID      int `json:"OwnerPID"`
+	Hostname string
+	Program  string
+	Started  time.Time
+	// Path is the directory of the lock, usually the repo path.
+	Path string
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s (pid %d) on %s, started at %s, for %s", o.Program, o.PID, o.Hostname, o.Started.Format(time.RFC3339), o.Path)
+}
+
+// newOwner returns the owner of a lock taken by the current process in
+// confdir.
+func newOwner(confdir string) (Owner, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Owner{}, err
+	}
+	hostname, _ := os.Hostname()
+	return Owner{
+		ID:       hex.EncodeToString(b),
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Program:  filepath.Base(os.Args[0]),
+		Started:  processStart,
+		Path:     confdir,
+	}, nil
+}
+
+// Liveness is the verdict of Inspect on the holder of a lock.
+type Liveness string
+
+const (
+	// Alive is the verdict for a running holder, or an unexpired lease.
+	Alive Liveness = "alive"
+	// Dead is the verdict for a holder which is not running anymore, or an
+	// expired lease. The lock can be broken.
+	Dead Liveness = "dead"
+	// Unknown is the verdict for a holder running on another host, or when
+	// the lock file doesn't tell its owner.
+	Unknown Liveness = "unknown"
+)
+
+// LockInfo is the result of Inspect.
+type LockInfo struct {
+	Owner Owner
+	// Expires is the expiry of the lease of a LeaseLocker, zero for the
+	// other lockers.
+	Expires  time.Time
+	Liveness Liveness
+}
+
+// readLockFile reads the lock file at path, whatever its locker. Its Expires
+// is zero unless written by a LeaseLocker.
+func readLockFile(fs afero.Fs, path string) (Lease, error) {
+	buf, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	var lf Lease
+	if len(buf) == 0 {
+		// being created, or written by an older version
+		return lf, nil
+	}
+	if err := json.Unmarshal(buf, &lf); err != nil {
+		return Lease{}, fmt.Errorf("%w %q: %v", errInvalidLockFile, path, err)
+	}
+	return lf, nil
+}
+
+// Inspect returns the owner of the lock named lockFileName in confdir along
+// with a verdict on its liveness. The returned error satisfies os.IsNotExist
+// when the lock is not held, or is held by a locker without lock file.
+func Inspect(fs afero.Fs, confdir, lockFileName string) (LockInfo, error) {
+	lf, err := readLockFile(fs, filepath.Join(confdir, lockFileName))
+	if err != nil {
+		return LockInfo{}, err
+	}
+	return LockInfo{Owner: lf.Owner, Expires: lf.Expires, Liveness: liveness(lf)}, nil
+}
+
+func liveness(lf Lease) Liveness {
+	if !lf.Expires.IsZero() {
+		if time.Now().After(lf.Expires) {
+			return Dead
+		}
+		return Alive
+	}
+
+	if lf.PID == 0 {
+		return Unknown
+	}
+	if hostname, _ := os.Hostname(); lf.Hostname != "" && lf.Hostname != hostname {
+		// the PID is meaningless here
+		return Unknown
+	}
+	running, ok := lock.Running(lf.PID)
+	switch {
+	case !ok:
+		return Unknown
+	case running:
+		return Alive
+	default:
+		return Dead
+	}
+}
+
+// Break removes the lock named lockFileName in confdir, only if it is still
+// held by expected, as returned by Inspect. Otherwise it returns
+// ErrOwnerChanged. Breaking a lock which is not held succeeds.
+func Break(fs afero.Fs, confdir, lockFileName string, expected Owner) error {
+	path := filepath.Join(confdir, lockFileName)
+	err := removeLockFile(fs, path, func(lf Lease) bool {
+		return lf.Owner == expected
+	})
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case errors.As(err, new(LockedError)):
+		return ErrOwnerChanged
+	}
+	return err
+}
+
+// removeLockFile removes the lock file at path if match accepts its content.
+// The lock file is moved away before being checked, so a lock file written
+// concurrently by a new holder is never removed. A lock file refused by match
+// is put back unless a new holder created one in the meantime, which is then
+// left in place. The returned error wraps a LockedError if match refused the
+// lock file.
+func removeLockFile(fs afero.Fs, path string, match func(Lease) bool) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	// only one contender can move the lock file away
+	moved := path + "." + hex.EncodeToString(b) + ".removed"
+	if err := fs.Rename(path, moved); err != nil {
+		return err
+	}
+
+	lf, readErr := readLockFile(fs, moved)
+	if readErr == nil && match(lf) {
+		return fs.Remove(moved)
+	}
+
+	if err := restoreLockFile(fs, moved, path); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return lockedError(path, "lock owner changed")
+}
+
+// restoreLockFile moves the lock file moved back to path, without replacing
+// the lock file of a new holder.
+func restoreLockFile(fs afero.Fs, moved, path string) error {
+	if _, ok := fs.(*afero.OsFs); ok {
+		// unlike rename, link doesn't replace an existing file, and keeps
+		// the OS lock of the holder
+		if err := os.Link(moved, path); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return fs.Remove(moved)
+	}
+
+	st, err := fs.Stat(moved)
+	if err != nil {
+		return err
+	}
+	buf, err := afero.ReadFile(fs, moved)
+	if err != nil {
+		return err
+	}
+	f, err := atomicfile.NewExclusive(fs, path, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Close(); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return fs.Remove(moved)
+}
@@ -0,0 +1,134 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLockFile(t *testing.T, fs afero.Fs, path string, lf Lease) {
+	t.Helper()
+	buf, err := json.Marshal(lf)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, path, buf, 0644))
+}
+
+func TestInspect(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	hostname, _ := os.Hostname()
+
+	_, err := Inspect(fs, "/repo", "test.lock")
+	require.True(t, os.IsNotExist(err), "expected a not exist error, got %v", err)
+
+	lk, err := Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	info, err := Inspect(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Owner.ID)
+	require.Equal(t, os.Getpid(), info.Owner.PID)
+	require.Equal(t, hostname, info.Owner.Hostname)
+	require.Equal(t, filepath.Base(os.Args[0]), info.Owner.Program)
+	require.Equal(t, "/repo", info.Owner.Path)
+	require.False(t, info.Owner.Started.IsZero())
+	require.True(t, info.Expires.IsZero())
+	require.Equal(t, Alive, info.Liveness)
+
+	require.NoError(t, lk.Close())
+
+	path := filepath.Join("/repo", "test.lock")
+	for _, tc := range []struct {
+		name     string
+		lf       Lease
+		liveness Liveness
+	}{
+		{"dead", Lease{Owner: Owner{PID: 99999999, Hostname: hostname}}, Dead},
+		{"other host", Lease{Owner: Owner{PID: 99999999, Hostname: "elsewhere"}}, Unknown},
+		{"no owner", Lease{}, Unknown},
+		{"lease", Lease{Owner: Owner{ID: "a", Hostname: "elsewhere"}, Expires: time.Now().Add(time.Minute)}, Alive},
+		{"expired lease", Lease{Owner: Owner{ID: "a", Hostname: "elsewhere"}, Expires: time.Now().Add(-time.Minute)}, Dead},
+	} {
+		writeLockFile(t, fs, path, tc.lf)
+		info, err := Inspect(fs, "/repo", "test.lock")
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.liveness, info.Liveness, tc.name)
+	}
+}
+
+func TestLockedErrorOwner(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := filepath.Join("/repo", "test.lock")
+	hostname, _ := os.Hostname()
+	writeLockFile(t, fs, path, Lease{Owner: Owner{ID: "a", PID: os.Getpid(), Hostname: hostname, Program: "other"}})
+
+	_, err := Lock(fs, "/repo", "test.lock")
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+	require.True(t, strings.Contains(err.Error(), "other (pid"), "expected the owner in %q", err)
+}
+
+func TestBreak(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := filepath.Join("/repo", "test.lock")
+
+	require.NoError(t, Break(fs, "/repo", "test.lock", Owner{}))
+
+	lk, err := LeaseLocker{}.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	info, err := Inspect(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+
+	// relocked by someone else meanwhile
+	lk, err = LeaseLocker{}.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	defer lk.Close()
+	require.Equal(t, ErrOwnerChanged, Break(fs, "/repo", "test.lock", info.Owner))
+	exists, err := afero.Exists(fs, path)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	info, err = Inspect(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, Break(fs, "/repo", "test.lock", info.Owner))
+	exists, err = afero.Exists(fs, path)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// the lock can be taken again
+	other, err := LeaseLocker{}.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+}
+
+func TestRemoveLockFileKeepsNewHolder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, fs := range []afero.Fs{afero.NewMemMapFs(), afero.NewOsFs()} {
+		path := filepath.Join(dir, "test.lock")
+		require.NoError(t, fs.MkdirAll(dir, 0755))
+		writeLockFile(t, fs, path, Lease{Owner: Owner{ID: "old"}})
+
+		// a new holder creates the lock file while the old one is checked
+		err := removeLockFile(fs, path, func(Lease) bool {
+			writeLockFile(t, fs, path, Lease{Owner: Owner{ID: "new"}})
+			return false
+		})
+		require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+
+		lf, err := readLockFile(fs, path)
+		require.NoError(t, err)
+		require.Equal(t, "new", lf.ID)
+		infos, err := afero.ReadDir(fs, dir)
+		require.NoError(t, err)
+		require.Len(t, infos, 1, "the moved lock file was left behind")
+		require.NoError(t, fs.Remove(path))
+	}
+}
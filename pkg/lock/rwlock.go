@@ -0,0 +1,247 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+var (
+	// SharedLocker is the reader side of a reader/writer lock: any number of
+	// SharedLocker holders can hold the lock together, but not along with an
+	// ExclusiveLocker holder.
+	SharedLocker Locker = LockerFunc(lockShared)
+
+	// ExclusiveLocker is the writer side of a reader/writer lock, it holds
+	// the lock alone. It is taken with PIDFileLocker, so it also excludes the
+	// PIDFileLocker holders.
+	ExclusiveLocker Locker = LockerFunc(lockExclusive)
+)
+
+const (
+	// rwLockDirSuffix is appended to the name of a reader/writer lock to name
+	// the directory holding an entry per holder.
+	rwLockDirSuffix = ".d"
+	sharedPrefix    = "shared-"
+	exclusiveEntry  = "exclusive"
+
+	// gateTimeout bounds the wait of a reader for the gate held by another
+	// reader.
+	gateTimeout       = time.Second
+	gateRetryInterval = 10 * time.Millisecond
+)
+
+// The lock file of a reader/writer lock, taken with PIDFileLocker, is its
+// gate: writers hold it until they are closed, readers only while adding or
+// removing their entry in the lock directory. So a reader can't join while a
+// writer holds the lock, and a writer can't take the lock before the live
+// readers left.
+
+func rwLockDir(confdir, lockFileName string) string {
+	return filepath.Join(confdir, lockFileName+rwLockDirSuffix)
+}
+
+// Readers returns the holders of the SharedLocker lock named lockFileName in
+// confdir, including the dead ones which will be removed by the next
+// ExclusiveLocker.
+func Readers(fs afero.Fs, confdir, lockFileName string) ([]LockInfo, error) {
+	dir := rwLockDir(confdir, lockFileName)
+	names, err := readDirNames(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var readers []LockInfo
+	for _, name := range names {
+		if !strings.HasPrefix(name, sharedPrefix) {
+			continue
+		}
+		info, err := Inspect(fs, dir, name)
+		if os.IsNotExist(err) {
+			// left since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		readers = append(readers, info)
+	}
+	return readers, nil
+}
+
+func readDirNames(fs afero.Fs, dir string) ([]string, error) {
+	d, err := fs.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+func lockExclusive(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	gate, err := Lock(fs, confdir, lockFileName)
+	if err != nil {
+		return nil, err
+	}
+	u, err := lockExclusiveGated(fs, confdir, lockFileName, gate)
+	if err != nil {
+		gate.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+func lockExclusiveGated(fs afero.Fs, confdir, lockFileName string, gate io.Closer) (io.Closer, error) {
+	dir := rwLockDir(confdir, lockFileName)
+	readers, err := Readers(fs, confdir, lockFileName)
+	if err != nil {
+		return nil, err
+	}
+	live := 0
+	for _, r := range readers {
+		if r.Liveness != Dead {
+			live++
+			continue
+		}
+		// the entry of a reader is only written by the reader, under the
+		// gate we hold
+		err := fs.Remove(filepath.Join(dir, sharedPrefix+r.Owner.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if live > 0 {
+		return nil, lockedError(filepath.Join(confdir, lockFileName), fmt.Sprintf("shared by %d readers", live))
+	}
+
+	owner, err := newOwner(confdir)
+	if err != nil {
+		return nil, err
+	}
+	entry := filepath.Join(dir, exclusiveEntry)
+	// left by a writer which crashed
+	if err := fs.Remove(entry); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := writeEntry(fs, entry, owner); err != nil {
+		return nil, err
+	}
+	return &rwUnlocker{fs: fs, dir: dir, entry: entry, gate: gate}, nil
+}
+
+func lockShared(fs afero.Fs, confdir, lockFileName string) (io.Closer, error) {
+	owner, err := newOwner(confdir)
+	if err != nil {
+		return nil, err
+	}
+	dir := rwLockDir(confdir, lockFileName)
+	entry := filepath.Join(dir, sharedPrefix+owner.ID)
+
+	err = withGate(fs, confdir, lockFileName, func() error {
+		return writeEntry(fs, entry, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rwUnlocker{fs: fs, dir: dir, entry: entry, confdir: confdir, lockFileName: lockFileName}, nil
+}
+
+// withGate runs fn while holding the gate of a reader/writer lock. It waits
+// for the gate held by another reader, but fails if a writer holds it.
+func withGate(fs afero.Fs, confdir, lockFileName string, fn func() error) error {
+	exclusive := filepath.Join(rwLockDir(confdir, lockFileName), exclusiveEntry)
+	deadline := time.Now().Add(gateTimeout)
+	for {
+		gate, err := Lock(fs, confdir, lockFileName)
+		if err == nil {
+			defer gate.Close()
+			return fn()
+		}
+		if !errors.As(err, new(LockedError)) || time.Now().After(deadline) {
+			return err
+		}
+		if lf, err := readLockFile(fs, exclusive); err == nil && liveness(lf) != Dead {
+			return lockedError(filepath.Join(confdir, lockFileName), "held exclusively by "+lf.Owner.String())
+		}
+		time.Sleep(gateRetryInterval)
+	}
+}
+
+// writeEntry writes the entry of a holder in the lock directory.
+func writeEntry(fs afero.Fs, path string, owner Owner) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := atomicfile.NewExclusive(fs, path, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(owner); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// removeEntry removes the entry of a holder, and the lock directory once
+// empty. The gate must be held.
+func removeEntry(fs afero.Fs, dir, entry string) error {
+	if err := fs.Remove(entry); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	names, err := readDirNames(fs, dir)
+	if err != nil || len(names) > 0 {
+		return err
+	}
+	return fs.Remove(dir)
+}
+
+// rwUnlocker releases a reader/writer lock. gate is nil for readers, which
+// take it again to leave.
+type rwUnlocker struct {
+	fs    afero.Fs
+	dir   string
+	entry string
+	gate  io.Closer
+
+	confdir      string
+	lockFileName string
+
+	once sync.Once
+	err  error
+}
+
+func (u *rwUnlocker) Close() error {
+	u.once.Do(func() {
+		if u.gate != nil {
+			u.err = removeEntry(u.fs, u.dir, u.entry)
+			if err := u.gate.Close(); u.err == nil {
+				u.err = err
+			}
+			return
+		}
+
+		err := withGate(u.fs, u.confdir, u.lockFileName, func() error {
+			return removeEntry(u.fs, u.dir, u.entry)
+		})
+		if err != nil {
+			// leave the lock directory for the next holders to remove
+			u.err = u.fs.Remove(u.entry)
+			if os.IsNotExist(u.err) {
+				u.err = nil
+			}
+		}
+	})
+	return u.err
+}
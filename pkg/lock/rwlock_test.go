@@ -0,0 +1,86 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func requireLocked(t *testing.T, err error) {
+	t.Helper()
+	require.True(t, errors.As(err, new(LockedError)), "expected a LockedError, got %v", err)
+}
+
+func TestExclusiveLocker(t *testing.T) {
+	testLocker(t, ExclusiveLocker, afero.NewMemMapFs(), "/repo")
+}
+
+func TestSharedLocker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := rwLockDir("/repo", "test.lock")
+
+	r1, err := SharedLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	r2, err := SharedLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	readers, err := Readers(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.Len(t, readers, 2)
+	require.Equal(t, Alive, readers[0].Liveness)
+
+	// readers block the writers, including PIDFileLocker
+	_, err = ExclusiveLocker.Lock(fs, "/repo", "test.lock")
+	requireLocked(t, err)
+	require.NoError(t, r1.Close())
+	_, err = ExclusiveLocker.Lock(fs, "/repo", "test.lock")
+	requireLocked(t, err)
+	require.NoError(t, r2.Close())
+	exists, err := afero.DirExists(fs, dir)
+	require.NoError(t, err)
+	require.False(t, exists, "the lock directory must be removed by the last holder")
+
+	// a writer blocks the new readers without waiting for the gate
+	w, err := ExclusiveLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = SharedLocker.Lock(fs, "/repo", "test.lock")
+	requireLocked(t, err)
+	require.Less(t, int64(time.Since(start)), int64(gateTimeout))
+	_, err = PIDFileLocker.Lock(fs, "/repo", "test.lock")
+	requireLocked(t, err)
+	require.NoError(t, w.Close())
+
+	r1, err = SharedLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.NoError(t, r1.Close())
+}
+
+func TestSharedLockerDeadReader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := rwLockDir("/repo", "test.lock")
+	hostname, _ := os.Hostname()
+
+	// left by a reader which crashed
+	writeLockFile(t, fs, filepath.Join(dir, sharedPrefix+"dead"), Lease{Owner: Owner{ID: "dead", PID: 99999999, Hostname: hostname}})
+	readers, err := Readers(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.Len(t, readers, 1)
+	require.Equal(t, Dead, readers[0].Liveness)
+
+	w, err := ExclusiveLocker.Lock(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	readers, err = Readers(fs, "/repo", "test.lock")
+	require.NoError(t, err)
+	require.Empty(t, readers)
+	require.NoError(t, w.Close())
+
+	// a reader on another host may still be alive
+	writeLockFile(t, fs, filepath.Join(dir, sharedPrefix+"remote"), Lease{Owner: Owner{ID: "remote", PID: 99999999, Hostname: "elsewhere"}})
+	_, err = ExclusiveLocker.Lock(fs, "/repo", "test.lock")
+	requireLocked(t, err)
+}
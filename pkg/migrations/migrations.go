@@ -0,0 +1,313 @@
+// Package migrations upgrades and downgrades afero backed repos. Unlike the
+// fs-repo-migrations binaries, which only operate on the OS filesystem, the
+// migration steps run in process against any afero.Fs.
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
+	"github.com/berty/go-ipfs-repo-afero/pkg/repo"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// same lock as the one taken by repo.Open
+	repoLock    = "repo.lock"
+	versionFile = "version"
+
+	// BackupDir is the directory of the repo where the files touched by each
+	// step are backed up while it runs.
+	BackupDir = "migrations-backup"
+
+	// backupCompleteSuffix names the file marking a backup as complete
+	backupCompleteSuffix = ".complete"
+)
+
+var (
+	ErrNoMigration  = errors.New("no migration registered")
+	ErrIrreversible = errors.New("migration can't be reverted")
+)
+
+// Step migrates a repo from version From to From+1.
+type Step struct {
+	From int
+
+	// Files are the paths, relative to the repo, of the files and directories
+	// the step may modify. They are backed up before the step runs and
+	// restored if it fails.
+	Files []string
+
+	Apply func(fs afero.Fs, path string) error
+
+	// Revert migrates a repo from version From+1 back to From, it is nil if
+	// the step can't be reverted.
+	Revert func(fs afero.Fs, path string) error
+}
+
+var steps = map[int]Step{}
+
+// Register adds a step to the ones run by Migrate.
+func Register(s Step) error {
+	if s.Apply == nil {
+		return fmt.Errorf("migration from version %d has no Apply func", s.From)
+	}
+	if _, ok := steps[s.From]; ok {
+		return fmt.Errorf("already have a migration from version %d", s.From)
+	}
+
+	steps[s.From] = s
+	return nil
+}
+
+// Migrate runs the registered steps needed to bring the repo at path to the
+// target version, reverting steps if the repo is newer than target. The repo
+// must not be opened. The version file is updated after each step, so a
+// failed migration leaves the repo at the version of the last successful step.
+func Migrate(fs afero.Fs, path string, target int) error {
+	return migrate(fs, path, target, steps)
+}
+
+func migrate(fs afero.Fs, path string, target int, steps map[int]Step) error {
+	path, err := homedir.Expand(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	lk, err := lockfile.ExclusiveLocker.Lock(fs, path, repoLock)
+	if err != nil {
+		return errors.Wrap(err, "lock repo")
+	}
+	defer lk.Close()
+
+	ver, err := repo.GetRepoVersion(fs, path)
+	if err != nil {
+		return errors.Wrap(err, "get repo version")
+	}
+
+	plan, err := planSteps(steps, ver, target)
+	if err != nil {
+		return err
+	}
+	if err := removeStaleBackups(fs, path, ver); err != nil {
+		return errors.Wrap(err, "remove stale backups")
+	}
+
+	for _, p := range plan {
+		if err := p.run(fs, path); err != nil {
+			return errors.Wrapf(err, "migrate from version %d to %d", p.from, p.to)
+		}
+		if err := writeVersion(fs, path, p.to); err != nil {
+			return errors.Wrap(err, "write repo version")
+		}
+		if err := removeBackup(fs, p.backup(path)); err != nil {
+			return errors.Wrap(err, "remove backup")
+		}
+	}
+
+	return nil
+}
+
+type plannedStep struct {
+	from, to int
+	files    []string
+	fn       func(fs afero.Fs, path string) error
+}
+
+// planSteps returns the steps going from version ver to target, failing
+// before anything is run if one of them is missing.
+func planSteps(steps map[int]Step, ver, target int) ([]plannedStep, error) {
+	var plan []plannedStep
+
+	for v := ver; v < target; v++ {
+		s, ok := steps[v]
+		if !ok {
+			return nil, errors.Wrapf(ErrNoMigration, "from version %d to %d", v, v+1)
+		}
+		plan = append(plan, plannedStep{from: v, to: v + 1, files: s.Files, fn: s.Apply})
+	}
+
+	for v := ver; v > target; v-- {
+		s, ok := steps[v-1]
+		if !ok {
+			return nil, errors.Wrapf(ErrNoMigration, "from version %d to %d", v, v-1)
+		}
+		if s.Revert == nil {
+			return nil, errors.Wrapf(ErrIrreversible, "from version %d to %d", v, v-1)
+		}
+		plan = append(plan, plannedStep{from: v, to: v - 1, files: s.Files, fn: s.Revert})
+	}
+
+	return plan, nil
+}
+
+// run backs up the files of the step then runs it, restoring the backup if
+// it fails. A complete backup left by a run interrupted by a crash is restored
+// before the step runs again, the backup is only removed by the caller once
+// the step succeeded and the version was written.
+func (p plannedStep) run(fs afero.Fs, path string) error {
+	backup := p.backup(path)
+
+	complete, err := afero.Exists(fs, backup+backupCompleteSuffix)
+	if err != nil {
+		return err
+	}
+	if complete {
+		if err := restore(fs, path, backup, p.files); err != nil {
+			return errors.Wrap(err, "restore backup of interrupted migration")
+		}
+	} else {
+		// the backup was interrupted before the step ran, the files are
+		// untouched
+		if err := fs.RemoveAll(backup); err != nil {
+			return err
+		}
+		for _, f := range p.files {
+			err := copyTree(fs, filepath.Join(path, f), filepath.Join(backup, f))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "backup %s", f)
+			}
+		}
+		if err := markComplete(fs, backup); err != nil {
+			return errors.Wrap(err, "complete backup")
+		}
+	}
+
+	if err := p.fn(fs, path); err != nil {
+		if rerr := restore(fs, path, backup, p.files); rerr != nil {
+			return errors.Wrapf(err, "restore backup: %v", rerr)
+		}
+		if rerr := removeBackup(fs, backup); rerr != nil {
+			return errors.Wrapf(err, "remove backup: %v", rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (p plannedStep) backup(path string) string {
+	return filepath.Join(path, BackupDir, fmt.Sprintf("%d-to-%d", p.from, p.to))
+}
+
+// markComplete marks backup as complete, once all of its files are written.
+func markComplete(fs afero.Fs, backup string) error {
+	if err := fs.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return err
+	}
+	f, err := atomicfile.New(fs, backup+backupCompleteSuffix, 0644, atomicfile.SyncFile(), atomicfile.SyncDir())
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeBackup removes the completion marker of backup before the backup
+// itself, so a partially removed backup is never restored.
+func removeBackup(fs afero.Fs, backup string) error {
+	if err := fs.Remove(backup + backupCompleteSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fs.RemoveAll(backup)
+}
+
+// removeStaleBackups removes the backups of the steps which don't start from
+// the version ver of the repo: they were left by a crash after the version of
+// a successful step was written.
+func removeStaleBackups(fs afero.Fs, path string, ver int) error {
+	dir := filepath.Join(path, BackupDir)
+	infos, err := afero.ReadDir(fs, dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), backupCompleteSuffix)
+		var from, to int
+		if _, err := fmt.Sscanf(name, "%d-to-%d", &from, &to); err != nil || from == ver {
+			continue
+		}
+		if err := removeBackup(fs, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore puts back the backed up files, removing the ones which didn't
+// exist before the step.
+func restore(fs afero.Fs, path, backup string, files []string) error {
+	for _, f := range files {
+		if err := fs.RemoveAll(filepath.Join(path, f)); err != nil {
+			return err
+		}
+		err := copyTree(fs, filepath.Join(backup, f), filepath.Join(path, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the file or directory src to dst.
+func copyTree(fs afero.Fs, src, dst string) error {
+	if _, err := fs.Stat(src); err != nil {
+		return err
+	}
+
+	return afero.Walk(fs, src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return fs.MkdirAll(target, info.Mode().Perm())
+		}
+
+		if err := fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		buf, err := afero.ReadFile(fs, p)
+		if err != nil {
+			return err
+		}
+
+		// the backup must be on disk before the step modifies the files
+		f, err := atomicfile.New(fs, target, info.Mode().Perm(), atomicfile.SyncFile(), atomicfile.SyncDir())
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(buf); err != nil {
+			f.Abort()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+func writeVersion(fs afero.Fs, path string, version int) error {
+	f, err := atomicfile.New(fs, filepath.Join(path, versionFile), 0644, atomicfile.SyncFile(), atomicfile.SyncDir())
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.Itoa(version) + "\n"); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
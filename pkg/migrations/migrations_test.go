@@ -0,0 +1,186 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/repo"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func writeStep(name, content string) func(fs afero.Fs, path string) error {
+	return func(fs afero.Fs, path string) error {
+		return afero.WriteFile(fs, filepath.Join(path, name), []byte(content), 0644)
+	}
+}
+
+func requireFile(t *testing.T, fs afero.Fs, fn, content string) {
+	buf, err := afero.ReadFile(fs, fn)
+	require.NoError(t, err)
+	require.Equal(t, content, string(buf))
+}
+
+func TestMigrate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/repo"
+	require.NoError(t, repo.Init(fs, path, &config.Config{Datastore: repo.DefaultDatastoreConfig()}))
+
+	from := repo.RepoVersion
+	errStep := errors.New("step failed")
+	steps := map[int]Step{
+		from: {
+			From:   from,
+			Files:  []string{"foo"},
+			Apply:  writeStep("foo", "v1"),
+			Revert: func(fs afero.Fs, path string) error { return fs.Remove(filepath.Join(path, "foo")) },
+		},
+		from + 1: {
+			From:  from + 1,
+			Files: []string{"foo"},
+			Apply: func(fs afero.Fs, path string) error {
+				if err := writeStep("foo", "half migrated")(fs, path); err != nil {
+					return err
+				}
+				return errStep
+			},
+		},
+	}
+
+	version := func() int {
+		ver, err := repo.GetRepoVersion(fs, path)
+		require.NoError(t, err)
+		return ver
+	}
+
+	// a failed step is rolled back and the repo stays at the previous version
+	err := migrate(fs, path, from+2, steps)
+	require.ErrorIs(t, err, errStep)
+	require.Equal(t, from+1, version())
+	requireFile(t, fs, filepath.Join(path, "foo"), "v1")
+	exists, err := afero.Exists(fs, filepath.Join(path, BackupDir, fmt.Sprintf("%d-to-%d", from+1, from+2)))
+	require.NoError(t, err)
+	require.False(t, exists, "backup of the failed step was not removed")
+
+	// missing and irreversible steps are detected before anything is run
+	require.ErrorIs(t, migrate(fs, path, from+3, steps), ErrNoMigration)
+	require.ErrorIs(t, migrate(fs, path, from-1, steps), ErrNoMigration)
+	require.Equal(t, from+1, version())
+
+	require.NoError(t, migrate(fs, path, from, steps))
+	require.Equal(t, from, version())
+	exists, err = afero.Exists(fs, filepath.Join(path, "foo"))
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = afero.Exists(fs, filepath.Join(path, BackupDir, fmt.Sprintf("%d-to-%d", from+1, from)))
+	require.NoError(t, err)
+	require.False(t, exists, "backup of the successful step was not removed")
+
+	delete(steps, from+1)
+	steps[from] = Step{From: from, Apply: writeStep("foo", "v1")}
+	require.NoError(t, migrate(fs, path, from+1, steps))
+	require.ErrorIs(t, migrate(fs, path, from, steps), ErrIrreversible)
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/repo"
+	require.NoError(t, repo.Init(fs, path, &config.Config{Datastore: repo.DefaultDatastoreConfig()}))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(path, "foo"), []byte("v0"), 0644))
+
+	from := repo.RepoVersion
+	crash := Step{
+		From:  from,
+		Files: []string{"foo"},
+		Apply: func(fs afero.Fs, path string) error {
+			if err := writeStep("foo", "half migrated")(fs, path); err != nil {
+				return err
+			}
+			panic("crash")
+		},
+	}
+	require.Panics(t, func() { migrate(fs, path, from+1, map[int]Step{from: crash}) })
+
+	// the rerun starts from the files backed up before the crash
+	resume := Step{
+		From:  from,
+		Files: []string{"foo"},
+		Apply: func(fs afero.Fs, path string) error {
+			buf, err := afero.ReadFile(fs, filepath.Join(path, "foo"))
+			if err != nil {
+				return err
+			}
+			return writeStep("foo", string(buf)+"+v1")(fs, path)
+		},
+	}
+	require.NoError(t, migrate(fs, path, from+1, map[int]Step{from: resume}))
+	requireFile(t, fs, filepath.Join(path, "foo"), "v0+v1")
+
+	ver, err := repo.GetRepoVersion(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, from+1, ver)
+	exists, err := afero.Exists(fs, filepath.Join(path, BackupDir, fmt.Sprintf("%d-to-%d", from, from+1)))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestMigrateStaleBackup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/repo"
+	require.NoError(t, repo.Init(fs, path, &config.Config{Datastore: repo.DefaultDatastoreConfig()}))
+
+	from := repo.RepoVersion
+	steps := map[int]Step{
+		from:     {From: from, Files: []string{"foo"}, Apply: writeStep("foo", "v1")},
+		from + 1: {From: from + 1, Files: []string{"foo"}, Apply: writeStep("foo", "v2")},
+	}
+	require.NoError(t, migrate(fs, path, from+1, steps))
+
+	// the complete backup of a crash after the version was written
+	backup := filepath.Join(path, BackupDir, fmt.Sprintf("%d-to-%d", from, from+1))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(backup, "foo"), []byte("v0"), 0644))
+	require.NoError(t, afero.WriteFile(fs, backup+backupCompleteSuffix, nil, 0644))
+
+	require.NoError(t, migrate(fs, path, from+2, steps))
+	requireFile(t, fs, filepath.Join(path, "foo"), "v2")
+	for _, fn := range []string{backup, backup + backupCompleteSuffix} {
+		exists, err := afero.Exists(fs, fn)
+		require.NoError(t, err)
+		require.False(t, exists, "%s was not removed", fn)
+	}
+}
+
+func TestMigrateLocked(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/repo"
+	require.NoError(t, repo.Init(fs, path, &config.Config{Datastore: repo.DefaultDatastoreConfig()}))
+
+	r, err := repo.Open(fs, path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	steps := map[int]Step{repo.RepoVersion: {From: repo.RepoVersion, Apply: writeStep("foo", "v1")}}
+	require.Error(t, migrate(fs, path, repo.RepoVersion+1, steps))
+
+	ver, err := repo.GetRepoVersion(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, repo.RepoVersion, ver)
+
+	// nor while it is read
+	require.NoError(t, r.Close())
+	ro, err := repo.OpenReadOnly(fs, path)
+	require.NoError(t, err)
+	defer ro.Close()
+	require.Error(t, migrate(fs, path, repo.RepoVersion+1, steps))
+}
+
+func TestRegister(t *testing.T) {
+	defer func() { steps = map[int]Step{} }()
+
+	require.Error(t, Register(Step{From: 1}))
+	require.NoError(t, Register(Step{From: 1, Apply: writeStep("foo", "v1")}))
+	require.Error(t, Register(Step{From: 1, Apply: writeStep("foo", "v1")}))
+}
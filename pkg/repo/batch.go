@@ -0,0 +1,461 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// A batch is committed by staging its values in a journal directory, then
+// renaming a commit marker into it. Committed journals are replayed and
+// uncommitted ones discarded when the datastore is opened, so a crash never
+// leaves a batch half applied.
+const (
+	journalDir       = ".journal"
+	journalOpsFn     = "ops"
+	journalCommitFn  = "COMMIT"
+	journalCommitTmp = "COMMIT.tmp"
+
+	// journalGroupFn holds the path of the marker committing the journals
+	// of a group, relative to the journal root, see commitJournals
+	journalGroupFn         = "GROUP"
+	journalMarkerPrefix    = "commit-"
+	journalMarkerTmpPrefix = "commit-tmp-"
+)
+
+// ErrReservedKey is returned when writing a key which would be stored in the
+// journal directory.
+var ErrReservedKey = errors.New("key is reserved by the datastore")
+
+type batchOp struct {
+	delete bool
+	value  []byte
+}
+
+type journalEntry struct {
+	Key    string `json:"key"`
+	Delete bool   `json:"delete,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+type aferoBatch struct {
+	ads *aferoDatastore
+	ops map[ds.Key]batchOp
+}
+
+var _ ds.Batch = (*aferoBatch)(nil)
+
+func (ads *aferoDatastore) Batch() (ds.Batch, error) {
+	if ads.readOnly {
+		return nil, ErrReadOnly
+	}
+	return &aferoBatch{ads: ads, ops: make(map[ds.Key]batchOp)}, nil
+}
+
+func (b *aferoBatch) Put(key ds.Key, value []byte) error {
+	if err := b.ads.checkKey(key); err != nil {
+		return err
+	}
+	b.ops[key] = batchOp{value: value}
+	return nil
+}
+
+func (b *aferoBatch) Delete(key ds.Key) error {
+	if err := b.ads.checkKey(key); err != nil {
+		return err
+	}
+	b.ops[key] = batchOp{delete: true}
+	return nil
+}
+
+func (b *aferoBatch) Commit() error {
+	b.ads.txnLock.RLock()
+	defer b.ads.txnLock.RUnlock()
+
+	return b.ads.commit(b.ops)
+}
+
+// checkKey fails for the keys whose object would be stored in the journal
+// directory.
+func (ads *aferoDatastore) checkKey(key ds.Key) error {
+	rel, err := filepath.Rel(ads.path, ads.KeyFilename(key))
+	if err != nil {
+		return err
+	}
+	if strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] == journalDir {
+		return errors.Wrap(ErrReservedKey, key.String())
+	}
+	return nil
+}
+
+// commit atomically applies ops. If an error is returned after the commit
+// marker was written, the ops are applied by the next write, or when the
+// datastore is next opened.
+func (ads *aferoDatastore) commit(ops map[ds.Key]batchOp) error {
+	if ads.isClosed() {
+		return ErrClosed
+	}
+	if len(ops) == 0 {
+		return ads.replayPending()
+	}
+
+	dir, err := ads.stageJournal(ops)
+	if err != nil {
+		return errors.Wrap(err, "stage batch")
+	}
+	if err := ads.markCommitted(dir); err != nil {
+		ads.abortJournal(dir)
+		return errors.Wrap(err, "commit batch")
+	}
+	return ads.publishJournal(dir)
+}
+
+// publishJournal replays the committed journal dir, after the journals
+// committed before.
+func (ads *aferoDatastore) publishJournal(dir string) error {
+	ads.journalLock.Lock()
+	defer ads.journalLock.Unlock()
+	ads.pending = append(ads.pending, dir)
+	return ads.replayPendingUnsynced()
+}
+
+// abortJournal removes the journal dir, unless it can't be removed and is
+// committed anyway: it is replayed by the next write then.
+func (ads *aferoDatastore) abortJournal(dir string) {
+	if err := ads.fs.RemoveAll(dir); err == nil {
+		return
+	}
+	if committed, _ := ads.isCommitted(dir); committed {
+		ads.journalLock.Lock()
+		ads.pending = append(ads.pending, dir)
+		ads.journalLock.Unlock()
+	}
+}
+
+// replayPending replays the committed journals whose replay failed. The
+// writes fail until it succeeds, a journal replayed later would revert them.
+func (ads *aferoDatastore) replayPending() error {
+	ads.journalLock.Lock()
+	defer ads.journalLock.Unlock()
+	return ads.replayPendingUnsynced()
+}
+
+func (ads *aferoDatastore) replayPendingUnsynced() error {
+	for len(ads.pending) > 0 {
+		if err := ads.replayJournal(ads.pending[0]); err != nil {
+			return errors.Wrap(err, "replay batch")
+		}
+		ads.pending = ads.pending[1:]
+	}
+	return nil
+}
+
+// stageJournal writes ops in a new journal directory, which is not committed
+// yet.
+func (ads *aferoDatastore) stageJournal(ops map[ds.Key]batchOp) (string, error) {
+	jroot := filepath.Join(ads.path, journalDir)
+	if err := ads.fs.MkdirAll(jroot, 0755); err != nil {
+		return "", err
+	}
+
+	// prefix with the time so pending journals are replayed in order
+	dir, err := afero.TempDir(ads.fs, jroot, fmt.Sprintf("%020d-", time.Now().UnixNano()))
+	if err != nil {
+		return "", err
+	}
+
+	if err := ads.writeJournal(dir, ops); err != nil {
+		ads.fs.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (ads *aferoDatastore) writeJournal(dir string, ops map[ds.Key]batchOp) error {
+	entries := make([]journalEntry, 0, len(ops))
+	for key, op := range ops {
+		e := journalEntry{Key: key.String(), Delete: op.delete}
+		if !op.delete {
+			e.File = strconv.Itoa(len(entries))
+			if err := writeFile(ads.fs, filepath.Join(dir, e.File), op.value, ads.sync); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFile(ads.fs, filepath.Join(dir, journalOpsFn), buf, ads.sync)
+}
+
+// markCommitted commits the staged journal dir by renaming its commit marker
+// into it.
+func (ads *aferoDatastore) markCommitted(dir string) error {
+	if err := writeFile(ads.fs, filepath.Join(dir, journalCommitTmp), nil, ads.sync); err != nil {
+		return err
+	}
+	if err := ads.fs.Rename(filepath.Join(dir, journalCommitTmp), filepath.Join(dir, journalCommitFn)); err != nil {
+		return err
+	}
+
+	if ads.sync {
+		return atomicfile.FlushDir(ads.fs, dir)
+	}
+	return nil
+}
+
+// isCommitted returns whether the journal dir holds its commit marker, or
+// belongs to a committed group, see commitJournals.
+func (ads *aferoDatastore) isCommitted(dir string) (bool, error) {
+	committed, err := afero.Exists(ads.fs, filepath.Join(dir, journalCommitFn))
+	if err != nil || committed {
+		return committed, err
+	}
+
+	marker, err := readGroupFile(ads.fs, dir)
+	if err != nil || marker == "" {
+		return false, err
+	}
+	return afero.Exists(ads.fs, marker)
+}
+
+// readGroupFile returns the path of the group marker of the journal dir, or
+// an empty path if it doesn't belong to a group.
+func readGroupFile(fs afero.Fs, dir string) (string, error) {
+	buf, err := afero.ReadFile(fs, filepath.Join(dir, journalGroupFn))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dir), string(buf)), nil
+}
+
+// replayJournal applies a committed journal and removes it. Replaying is
+// idempotent: puts whose staged file is gone were already applied.
+func (ads *aferoDatastore) replayJournal(dir string) error {
+	buf, err := afero.ReadFile(ads.fs, filepath.Join(dir, journalOpsFn))
+	if err != nil {
+		return errors.Wrap(err, "read journal")
+	}
+
+	marker, err := readGroupFile(ads.fs, dir)
+	if err != nil {
+		return errors.Wrap(err, "read journal group")
+	}
+
+	var entries []journalEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return errors.Wrap(err, "decode journal")
+	}
+
+	dirs := make(map[string]struct{})
+	for _, e := range entries {
+		if err := ads.replayEntry(dir, e, dirs); err != nil {
+			return err
+		}
+	}
+
+	if ads.sync {
+		for d := range dirs {
+			if err := atomicfile.FlushDir(ads.fs, d); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ads.fs.RemoveAll(dir); err != nil {
+		return err
+	}
+	if marker != "" {
+		return removeGroupMarker(ads.fs, marker)
+	}
+	return nil
+}
+
+// replayEntry applies the journal entry e of dir, adding the directory of the
+// object it wrote to dirs.
+func (ads *aferoDatastore) replayEntry(dir string, e journalEntry, dirs map[string]struct{}) error {
+	key := ds.RawKey(e.Key)
+	fn := ads.KeyFilename(key)
+
+	defer ads.lockKey(key)()
+
+	oldSize := ads.objectSize(fn)
+
+	if e.Delete {
+		if !isFile(ads.fs, fn) {
+			return nil
+		}
+		if err := ads.recordWrite(key, fn); err != nil {
+			return err
+		}
+		if err := ads.fs.Remove(fn); err == nil {
+			ads.updateDiskUsage(-oldSize)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	staged := filepath.Join(dir, e.File)
+	info, err := ads.fs.Stat(staged)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := ads.recordWrite(key, fn); err != nil {
+		return err
+	}
+
+	if err := ads.fs.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	if err := ads.fs.Rename(staged, fn); err != nil {
+		return err
+	}
+	ads.updateDiskUsage(info.Size() - oldSize)
+	dirs[filepath.Dir(fn)] = struct{}{}
+	return nil
+}
+
+// recoverJournals replays the committed journals and discards the others.
+func (ads *aferoDatastore) recoverJournals() error {
+	jroot := filepath.Join(ads.path, journalDir)
+
+	infos, err := afero.ReadDir(ads.fs, jroot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		dir := filepath.Join(jroot, info.Name())
+		if !info.IsDir() {
+			continue
+		}
+
+		committed, err := ads.isCommitted(dir)
+		if err != nil {
+			return err
+		}
+
+		if committed {
+			err = ads.replayJournal(dir)
+		} else {
+			err = ads.fs.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, info := range infos {
+		p := filepath.Join(jroot, info.Name())
+		if info.IsDir() {
+			continue
+		}
+		// the journals of a group marker are all replayed or discarded by
+		// now, unless they belong to other datastores not opened yet
+		switch {
+		case strings.HasPrefix(info.Name(), journalMarkerTmpPrefix):
+			err = ignoreNotExist(ads.fs.Remove(p))
+		case strings.HasPrefix(info.Name(), journalMarkerPrefix):
+			err = removeGroupMarker(ads.fs, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupMarker lists the journals of a group, which are all committed once the
+// marker exists. The paths are relative to the journal root of the marker, so
+// the repo can be opened from another path.
+type groupMarker struct {
+	Journals []string `json:"journals"`
+}
+
+// commitJournals commits the staged journals dirs of several datastores
+// sharing a filesystem together: each journal refers to a single marker, and
+// is only committed once the marker exists. The marker is removed with the
+// last of its journals.
+func commitJournals(dss []*aferoDatastore, dirs []string) error {
+	fs := dss[0].fs
+	jroot, name := filepath.Split(dirs[0])
+	marker := filepath.Join(jroot, journalMarkerPrefix+name)
+	sync := false
+	journals := make([]string, len(dirs))
+	for i, ads := range dss {
+		sync = sync || ads.sync
+		rel, err := filepath.Rel(filepath.Dir(dirs[i]), marker)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(fs, filepath.Join(dirs[i], journalGroupFn), []byte(rel), ads.sync); err != nil {
+			return err
+		}
+		if journals[i], err = filepath.Rel(jroot, dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(groupMarker{Journals: journals})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(jroot, journalMarkerTmpPrefix+name)
+	if err := writeFile(fs, tmp, buf, sync); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, marker); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+
+	if sync {
+		return atomicfile.FlushDir(fs, jroot)
+	}
+	return nil
+}
+
+// removeGroupMarker removes the group marker once all its journals are
+// replayed.
+func removeGroupMarker(fs afero.Fs, marker string) error {
+	buf, err := afero.ReadFile(fs, marker)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var m groupMarker
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return errors.Wrap(err, "decode journal group marker")
+	}
+	for _, dir := range m.Journals {
+		exists, err := afero.DirExists(fs, filepath.Join(filepath.Dir(marker), dir))
+		if err != nil || exists {
+			return err
+		}
+	}
+	return ignoreNotExist(fs.Remove(marker))
+}
@@ -0,0 +1,240 @@
+package repo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+var errFault = errors.New("injected fault")
+
+// faultFs fails every mutating operation once budget operations were done,
+// simulating a process killed at that point.
+type faultFs struct {
+	afero.Fs
+	budget int
+}
+
+func (f *faultFs) step() error {
+	if f.budget <= 0 {
+		return errFault
+	}
+	f.budget--
+	return nil
+}
+
+func (f *faultFs) Create(name string) (afero.File, error) {
+	if err := f.step(); err != nil {
+		return nil, err
+	}
+	file, err := f.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *faultFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		return f.Fs.OpenFile(name, flag, perm)
+	}
+	if err := f.step(); err != nil {
+		return nil, err
+	}
+	file, err := f.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *faultFs) Mkdir(name string, perm os.FileMode) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.Mkdir(name, perm)
+}
+
+func (f *faultFs) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.MkdirAll(path, perm)
+}
+
+func (f *faultFs) Remove(name string) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.Remove(name)
+}
+
+func (f *faultFs) RemoveAll(path string) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.RemoveAll(path)
+}
+
+func (f *faultFs) Rename(oldname, newname string) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.Rename(oldname, newname)
+}
+
+func (f *faultFs) Chmod(name string, mode os.FileMode) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.Chmod(name, mode)
+}
+
+func (f *faultFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := f.step(); err != nil {
+		return err
+	}
+	return f.Fs.Chtimes(name, atime, mtime)
+}
+
+type faultFile struct {
+	afero.File
+	fs *faultFs
+}
+
+// Write tears the write in half when failing.
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.step(); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func TestAferoDatastoreBatchCrash(t *testing.T) {
+	dsc := &aferoDatastoreConfig{shardFunc: ShardNextToLast(2), sync: true}
+
+	oldState := map[string]string{"/a": "old-a", "/b": "old-b"}
+	newState := map[string]string{"/a": "new-a", "/c": "new-c"}
+
+	for budget := 0; ; budget++ {
+		fs := afero.NewMemMapFs()
+
+		d, err := newAferoDatastore(fs, "/ds", dsc)
+		require.NoError(t, err)
+		for k, v := range oldState {
+			require.NoError(t, d.Put(ds.NewKey(k), []byte(v)))
+		}
+
+		fd, err := newAferoDatastore(&faultFs{Fs: fs, budget: budget}, "/ds", dsc)
+		require.NoError(t, err)
+
+		b, err := fd.Batch()
+		require.NoError(t, err)
+		require.NoError(t, b.Put(ds.NewKey("/a"), []byte("new-a")))
+		require.NoError(t, b.Put(ds.NewKey("/c"), []byte("new-c")))
+		require.NoError(t, b.Delete(ds.NewKey("/b")))
+		commitErr := b.Commit()
+
+		// reopen as after a restart
+		d, err = newAferoDatastore(fs, "/ds", dsc)
+		require.NoError(t, err)
+
+		state := make(map[string]string)
+		for _, k := range []string{"/a", "/b", "/c"} {
+			v, err := d.Get(ds.NewKey(k))
+			if err == ds.ErrNotFound {
+				continue
+			}
+			require.NoError(t, err)
+			state[k] = string(v)
+		}
+
+		journals, err := afero.ReadDir(fs, filepath.Join("/ds", journalDir))
+		if !os.IsNotExist(err) {
+			require.NoError(t, err)
+		}
+		require.Empty(t, journals, "budget %d", budget)
+
+		if commitErr == nil {
+			require.Equal(t, newState, state)
+			return
+		}
+		require.ErrorIs(t, commitErr, errFault)
+		require.True(t, reflect.DeepEqual(oldState, state) || reflect.DeepEqual(newState, state),
+			"budget %d: batch partially applied: %v", budget, state)
+	}
+}
+
+func TestAferoDatastoreBatchReplayFailure(t *testing.T) {
+	dsc := &aferoDatastoreConfig{shardFunc: ShardNextToLast(2)}
+
+	pending := 0
+	for budget := 0; ; budget++ {
+		fs := afero.NewMemMapFs()
+		d, err := newAferoDatastore(fs, "/ds", dsc)
+		require.NoError(t, err)
+		require.NoError(t, d.Put(ds.NewKey("/b"), []byte("old-b")))
+
+		ffs := &faultFs{Fs: fs, budget: budget}
+		fd, err := newAferoDatastore(ffs, "/ds", dsc)
+		require.NoError(t, err)
+		b, err := fd.Batch()
+		require.NoError(t, err)
+		require.NoError(t, b.Put(ds.NewKey("/a"), []byte("batch-a")))
+		require.NoError(t, b.Delete(ds.NewKey("/b")))
+		if err := b.Commit(); err == nil {
+			break
+		}
+		if len(fd.pending) == 0 {
+			continue
+		}
+		pending++
+
+		// the next write replays the pending journal first, so it is not
+		// reverted by a later replay
+		require.ErrorIs(t, fd.Put(ds.NewKey("/b"), []byte("new-b")), errFault)
+		ffs.budget = 1 << 30
+		require.NoError(t, fd.Put(ds.NewKey("/b"), []byte("new-b")))
+		require.Empty(t, fd.pending)
+
+		d, err = newAferoDatastore(fs, "/ds", dsc)
+		require.NoError(t, err)
+		for k, expected := range map[string]string{"/a": "batch-a", "/b": "new-b"} {
+			v, err := d.Get(ds.NewKey(k))
+			require.NoError(t, err, "budget %d", budget)
+			require.Equal(t, expected, string(v), "budget %d", budget)
+		}
+	}
+	require.NotZero(t, pending, "no replay failure was injected")
+}
+
+func TestAferoDatastoreReservedKeys(t *testing.T) {
+	d, err := newAferoDatastore(afero.NewMemMapFs(), "/ds", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, d.Put(ds.NewKey("/"+journalDir+"/a"), nil), ErrReservedKey)
+	require.ErrorIs(t, d.Delete(ds.NewKey("/"+journalDir+"/a")), ErrReservedKey)
+	b, err := d.Batch()
+	require.NoError(t, err)
+	require.ErrorIs(t, b.Put(ds.NewKey("/"+journalDir+"/a"), nil), ErrReservedKey)
+	require.NoError(t, d.Put(ds.NewKey("/"+journalDir), []byte("a")))
+}
@@ -0,0 +1,398 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
+)
+
+// FindingKind is the kind of inconsistency reported by Check.
+type FindingKind string
+
+const (
+	FindingVersion       FindingKind = "version"
+	FindingConfig        FindingKind = "config"
+	FindingDatastoreSpec FindingKind = "datastore_spec"
+	FindingStaleLock     FindingKind = "stale_lock"
+	FindingTempFile      FindingKind = "temp_file"
+	FindingKeystoreEntry FindingKind = "keystore_entry"
+	FindingInvalidObject FindingKind = "invalid_object"
+)
+
+// Finding is an inconsistency found in a repo.
+type Finding struct {
+	Kind FindingKind
+	// Path is the file the finding is about.
+	Path string
+	Err  error
+	// Repairable is set when Repair can fix the finding without losing data.
+	Repairable bool
+	// Repaired is set when the finding was fixed by Repair.
+	Repaired bool
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %v", f.Kind, f.Path, f.Err)
+}
+
+// Check looks for the inconsistencies left in the repo at path by crashes and
+// power losses. It doesn't modify the repo and can run while it is opened.
+func Check(fs afero.Fs, path string) ([]Finding, error) {
+	return check(fs, path, false)
+}
+
+// Repair runs Check and fixes the findings which are safe to fix. The repo
+// must not be opened.
+func Repair(fs afero.Fs, path string) ([]Finding, error) {
+	return check(fs, path, true)
+}
+
+type checker struct {
+	fs       afero.Fs
+	path     string
+	repair   bool
+	findings []Finding
+}
+
+func check(fs afero.Fs, path string, repair bool) ([]Finding, error) {
+	path, err := homedir.Expand(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+
+	c := &checker{fs: fs, path: path, repair: repair}
+
+	if err := c.checkLock(); err != nil {
+		return c.findings, err
+	}
+	if repair {
+		lk, err := lockfile.ExclusiveLocker.Lock(fs, path, repoLock)
+		if err != nil {
+			return c.findings, errors.Wrap(err, "lock repo")
+		}
+		defer lk.Close()
+	}
+
+	steps := []func() error{
+		c.checkVersion,
+		c.checkTempFiles,
+		c.checkKeystore,
+		c.checkConfig,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return c.findings, err
+		}
+	}
+	return c.findings, nil
+}
+
+// add records a finding, fixing it with repairFn in repair mode. Findings
+// without repairFn are not repairable.
+func (c *checker) add(kind FindingKind, path string, err error, repairFn func() error) error {
+	f := Finding{Kind: kind, Path: path, Err: err, Repairable: repairFn != nil}
+	if c.repair && repairFn != nil {
+		if err := repairFn(); err != nil {
+			c.findings = append(c.findings, f)
+			return errors.Wrapf(err, "repair %s", path)
+		}
+		f.Repaired = true
+	}
+	c.findings = append(c.findings, f)
+	return nil
+}
+
+// checkLock looks for a repo lock left by a holder which is not running
+// anymore. It is broken in repair mode, unless it was taken over since.
+func (c *checker) checkLock() error {
+	fn := filepath.Join(c.path, repoLock)
+	info, err := lockfile.Inspect(c.fs, c.path, repoLock)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return c.add(FindingStaleLock, fn, err, nil)
+	case info.Liveness != lockfile.Dead:
+		return nil
+	}
+
+	reason := fmt.Errorf("lock owner %s is not running", info.Owner)
+	if !info.Expires.IsZero() {
+		reason = fmt.Errorf("lease of %s expired at %s", info.Owner, info.Expires.Format(time.RFC3339))
+	}
+	return c.add(FindingStaleLock, fn, reason, func() error {
+		return lockfile.Break(c.fs, c.path, repoLock, info.Owner)
+	})
+}
+
+func (c *checker) checkVersion() error {
+	fn := filepath.Join(c.path, versionFile)
+	_, err := repoVersion(c.fs, c.path)
+	switch {
+	case os.IsNotExist(err):
+		return c.add(FindingVersion, fn, errors.New("missing version file"), nil)
+	case err != nil:
+		return c.add(FindingVersion, fn, err, nil)
+	}
+	return nil
+}
+
+// checkTempFiles looks for the temp files of interrupted writes in the repo
+// root.
+func (c *checker) checkTempFiles() error {
+	infos, err := afero.ReadDir(c.fs, c.path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if name != "."+apiFile+".tmp" &&
+			!atomicfile.IsGroupTempFile(name) &&
+			!isTempFileOf(name, config.DefaultConfigFile) &&
+			!isTempFileOf(name, specFn) &&
+			!isTempFileOf(name, versionFile) {
+			continue
+		}
+		if err := c.removeTempFile(filepath.Join(c.path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checker) removeTempFile(fn string) error {
+	return c.add(FindingTempFile, fn, errors.New("leftover temp file"), func() error {
+		return ignoreNotExist(c.fs.Remove(fn))
+	})
+}
+
+// isTempFileOf returns whether name is an atomicfile temp file of base, those
+// are named after the file followed by random digits.
+func isTempFileOf(name, base string) bool {
+	if !strings.HasPrefix(name, base) || len(name) == len(base) {
+		return false
+	}
+	for _, c := range name[len(base):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) checkKeystore() error {
+	dir := filepath.Join(c.path, "keystore")
+	infos, err := afero.ReadDir(c.fs, dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		fn := filepath.Join(dir, info.Name())
+		if info.IsDir() || info.Name() == keystoreHeaderFn || info.Name() == keystoreAuditFn {
+			continue
+		}
+
+		if strings.HasPrefix(info.Name(), keyTempFilePrefix) {
+			// the key was never published
+			if err := c.add(FindingTempFile, fn, errors.New("leftover of an interrupted key write"), func() error {
+				return c.fs.Remove(fn)
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if isKeyInfoFile(info.Name()) {
+			kp := strings.TrimSuffix(fn, keyInfoSuffix)
+			if !FileExists(c.fs, kp) {
+				// the key was removed, but not its metadata
+				if err := c.add(FindingKeystoreEntry, fn, errors.New("metadata of a missing key"), func() error {
+					return c.fs.Remove(fn)
+				}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if _, err := decode(info.Name()); err != nil {
+			if err := c.add(FindingKeystoreEntry, fn, errors.Wrap(err, "decode name"), nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info.Size() == 0 {
+			// nothing to lose, the write of the key was interrupted
+			if err := c.add(FindingKeystoreEntry, fn, errors.New("empty key file"), func() error {
+				return c.fs.Remove(fn)
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		buf, err := afero.ReadFile(c.fs, fn)
+		if err != nil {
+			return err
+		}
+		if isEncryptedKey(buf) {
+			// can't be decoded without the passphrase
+			continue
+		}
+		if _, err := ci.UnmarshalPrivateKey(buf); err != nil {
+			if err := c.add(FindingKeystoreEntry, fn, errors.Wrap(err, "decode key"), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkConfig checks the config, then the datastore it describes.
+func (c *checker) checkConfig() error {
+	fn, err := config.Filename(c.path)
+	if err != nil {
+		return err
+	}
+
+	var mapconf map[string]interface{}
+	if err := ReadConfigFile(c.fs, fn, &mapconf); err != nil {
+		return c.add(FindingConfig, fn, err, nil)
+	}
+	conf, err := config.FromMap(mapconf)
+	if err != nil {
+		return c.add(FindingConfig, fn, err, nil)
+	}
+
+	dsc, err := AnyDatastoreConfig(conf.Datastore.Spec)
+	if err != nil {
+		return c.add(FindingConfig, fn, errors.Wrap(err, "get datastore config"), nil)
+	}
+
+	if err := c.checkSpec(dsc); err != nil {
+		return err
+	}
+
+	for _, adsc := range aferoDatastoreConfigs(dsc) {
+		if err := c.checkAferoDatastore(adsc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkSpec(dsc DatastoreConfig) error {
+	fn, err := config.Path(c.path, specFn)
+	if err != nil {
+		return err
+	}
+	spec := dsc.DiskSpec()
+
+	buf, err := afero.ReadFile(c.fs, fn)
+	if os.IsNotExist(err) {
+		// written from the config the same way Init does
+		return c.add(FindingDatastoreSpec, fn, errors.New("missing datastore spec"), func() error {
+			return afero.WriteFile(c.fs, fn, spec.Bytes(), 0600)
+		})
+	} else if err != nil {
+		return err
+	}
+
+	if onDisk := strings.TrimSpace(string(buf)); onDisk != spec.String() {
+		return c.add(FindingDatastoreSpec, fn, fmt.Errorf("datastore configuration of '%s' does not match what is on disk '%s'", spec.String(), onDisk), nil)
+	}
+	return nil
+}
+
+// checkAferoDatastore looks for temp files and objects which can't be reached
+// through their key.
+func (c *checker) checkAferoDatastore(dsc *aferoDatastoreConfig) error {
+	path := filepath.Join(c.path, dsc.path)
+	exists, err := afero.DirExists(c.fs, path)
+	if err != nil || !exists {
+		return err
+	}
+
+	shardFunc, err := readShardFunc(c.fs, path)
+	if err != nil {
+		return errors.Wrap(err, "read shard func")
+	}
+	if shardFunc == nil {
+		shardFunc = dsc.shardFunc
+	}
+	ads := &aferoDatastore{fs: c.fs, path: path}
+	if shardFunc != nil {
+		ads.shard = shardFunc.Func()
+	}
+
+	return afero.Walk(c.fs, path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return ignoreNotExist(err)
+		}
+		if info.IsDir() {
+			if p == filepath.Join(path, journalDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case isTempObjectFile(info.Name()) || isTempFileOf(info.Name(), diskUsageCacheFn):
+			return c.removeTempFile(p)
+		case strings.HasSuffix(p, ObjectKeySuffix):
+			key, ok := ads.filenameKey(p)
+			if !ok || key == "/" || ads.KeyFilename(ds.RawKey(key)) != p {
+				return c.add(FindingInvalidObject, p, errors.New("file name is not a valid key"), nil)
+			}
+		}
+		return nil
+	})
+}
+
+// aferoDatastoreConfigs returns the afero datastores of the datastore tree.
+func aferoDatastoreConfigs(dsc DatastoreConfig) []*aferoDatastoreConfig {
+	switch c := dsc.(type) {
+	case *aferoDatastoreConfig:
+		return []*aferoDatastoreConfig{c}
+	case *mountDatastoreConfig:
+		var res []*aferoDatastoreConfig
+		for _, m := range c.mounts {
+			res = append(res, aferoDatastoreConfigs(m.ds)...)
+		}
+		return res
+	case *logDatastoreConfig:
+		return aferoDatastoreConfigs(c.child)
+	case *measureDatastoreConfig:
+		return aferoDatastoreConfigs(c.child)
+	case *quotaDatastoreConfig:
+		return aferoDatastoreConfigs(c.child)
+	case *verifyDatastoreConfig:
+		return aferoDatastoreConfigs(c.child)
+	case *encryptedDatastoreConfig:
+		return aferoDatastoreConfigs(c.child)
+	}
+	return nil
+}
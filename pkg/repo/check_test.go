@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func findingKinds(findings []Finding) map[FindingKind]int {
+	kinds := make(map[FindingKind]int)
+	for _, f := range findings {
+		kinds[f.Kind]++
+	}
+	return kinds
+}
+
+func TestCheck(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "check", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ds.NewKey("/blocks/CIQFOO"), []byte("foo")))
+	require.NoError(t, r.Close())
+
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	write := func(fn, content string) {
+		require.NoError(t, fs.MkdirAll(filepath.Dir(fn), 0755))
+		require.NoError(t, afero.WriteFile(fs, fn, []byte(content), 0644))
+	}
+	// left by a crash of a process which is not running anymore
+	write(filepath.Join(path, repoLock), `{"OwnerPID":99999999}`)
+	write(filepath.Join(path, ".api.tmp"), "/ip4/127.0.0.1/tcp/5001")
+	write(filepath.Join(path, "config123456"), "{")
+	write(filepath.Join(path, "blocks", "OO", "CIQFOO.dsobject789"), "fo")
+	write(filepath.Join(path, "keystore", "key_mfrgg"), "")
+	write(filepath.Join(path, "keystore", "key_mfrgm"), "garbage")
+	write(filepath.Join(path, "blocks", "XX", "CIQFOO.dsobject"), "misplaced")
+	require.NoError(t, fs.Remove(filepath.Join(path, specFn)))
+
+	findings, err = Check(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, map[FindingKind]int{
+		FindingStaleLock:     1,
+		FindingTempFile:      3,
+		FindingKeystoreEntry: 2,
+		FindingDatastoreSpec: 1,
+		FindingInvalidObject: 1,
+	}, findingKinds(findings))
+	for _, f := range findings {
+		require.False(t, f.Repaired, f.String())
+	}
+
+	findings, err = Repair(fs, path)
+	require.NoError(t, err)
+	for _, f := range findings {
+		require.Equal(t, f.Repairable, f.Repaired, f.String())
+	}
+
+	// only the findings which would lose data are left
+	findings, err = Check(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, map[FindingKind]int{
+		FindingKeystoreEntry: 1,
+		FindingInvalidObject: 1,
+	}, findingKinds(findings))
+
+	r, err = Open(fs, path)
+	require.NoError(t, err)
+	value, err := r.Datastore().Get(ds.NewKey("/blocks/CIQFOO"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), value)
+
+	// the repo can't be repaired while it is opened
+	_, err = Repair(fs, path)
+	require.Error(t, err)
+	require.NoError(t, r.Close())
+}
+
+func TestCheckInvalidConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "check", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(path, versionFile), []byte("eleven\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(path, config.DefaultConfigFile), []byte(`{"Datastore":{"Spec":{"type":"unknown"}}}`), 0600))
+
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, map[FindingKind]int{
+		FindingVersion: 1,
+		FindingConfig:  1,
+	}, findingKinds(findings))
+
+	require.NoError(t, fs.Remove(filepath.Join(path, versionFile)))
+	findings, err = Repair(fs, path)
+	require.NoError(t, err)
+	require.Equal(t, map[FindingKind]int{
+		FindingVersion: 1,
+		FindingConfig:  1,
+	}, findingKinds(findings))
+}
+
+func TestCheckLock(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "check-lock", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+	lockPath := filepath.Join(path, repoLock)
+
+	// a lock file being created is not stale
+	require.NoError(t, afero.WriteFile(fs, lockPath, nil, 0644))
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	require.NoError(t, afero.WriteFile(fs, lockPath, []byte(`{"OwnerPID":99999999,"Program":"ipfs"}`), 0644))
+	findings, err = Check(fs, path)
+	require.NoError(t, err)
+	require.Len(t, findings, 1)
+	require.Contains(t, findings[0].Err.Error(), "ipfs (pid 99999999)")
+
+	findings, err = Repair(fs, path)
+	require.NoError(t, err)
+	require.Len(t, findings, 1)
+	require.True(t, findings[0].Repaired)
+	require.False(t, FileExists(fs, lockPath))
+}
@@ -1,11 +1,14 @@
 package repo
 
 import (
+	"path/filepath"
 	"strings"
 
 	config "github.com/ipfs/go-ipfs-config"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
 )
 
 // DefaultDatastoreConfig is an internal function exported to aid in testing.
@@ -28,10 +31,10 @@ func flatfsSpec() map[string]interface{} {
 				"type":       "measure",
 				"prefix":     "afero.blocks",
 				"child": map[string]interface{}{
-					"type": "afero",
-					"path": "blocks",
-					/*"sync":      true,
-					"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",*/
+					"type":      "afero",
+					"path":      "blocks",
+					"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+					"sync":      true,
 				},
 			},
 			map[string]interface{}{
@@ -59,10 +62,17 @@ func checkInitialized(fs afero.Fs, path string) error {
 	return nil
 }
 
-// isInitializedUnsynced reports whether the repo is initialized. Caller must
-// hold the packageLock.
+// isInitializedUnsynced reports whether the repo is initialized, and not in
+// the middle of a commit of its files. Caller must hold the packageLock.
 func isInitializedUnsynced(fs afero.Fs, repoPath string) bool {
-	return configIsInitialized(fs, repoPath)
+	if !configIsInitialized(fs, repoPath) {
+		return false
+	}
+	configFilename, err := config.Filename(repoPath)
+	if err != nil {
+		return false
+	}
+	return !atomicfile.Pending(fs, filepath.Dir(configFilename))
 }
 
 func configIsInitialized(fs afero.Fs, path string) bool {
@@ -0,0 +1,292 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrConfigIdentityChanged  = errors.New("the identity can't be changed while the repo is open")
+	ErrConfigDatastoreChanged = errors.New("the datastore spec can't be changed while the repo is open")
+)
+
+// ConfigChange is a change of the config of an AferoRepo, see Subscribe.
+type ConfigChange struct {
+	// Old and New are the configs before and after the change, shared with
+	// the callers of Config, they must not be modified.
+	Old, New *config.Config
+	// Keys are the sorted paths of the changed keys, like "Addresses.API".
+	Keys []string
+	// External is set when the config file was modified outside of the
+	// repo, see OpenOptions.ConfigPollInterval.
+	External bool
+}
+
+type configSubscriber struct {
+	ch   chan ConfigChange
+	wake chan struct{}
+
+	mu    sync.Mutex
+	queue []ConfigChange
+}
+
+func (s *configSubscriber) push(c ConfigChange) {
+	s.mu.Lock()
+	s.queue = append(s.queue, c)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *configSubscriber) pop() (ConfigChange, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return ConfigChange{}, false
+	}
+	c := s.queue[0]
+	s.queue = s.queue[1:]
+	return c, true
+}
+
+// ConfigSubscriber is implemented by the repos returned by Open and
+// OpenWithOptions, to be notified of the changes of their config.
+type ConfigSubscriber interface {
+	Subscribe(ctx context.Context) <-chan ConfigChange
+}
+
+var _ ConfigSubscriber = (*AferoRepo)(nil)
+
+// Subscribe returns a channel receiving the changes of the config, made with
+// SetConfig and SetConfigKey or picked by the config poller, in order. Slow
+// receivers don't block the repo, the changes are queued. The channel is
+// closed when ctx is done or the repo is closed.
+func (r *AferoRepo) Subscribe(ctx context.Context) <-chan ConfigChange {
+	packageLock.Lock()
+	defer packageLock.Unlock()
+
+	s := &configSubscriber{ch: make(chan ConfigChange), wake: make(chan struct{}, 1)}
+	if r.closed {
+		close(s.ch)
+		return s.ch
+	}
+	if r.subscribers == nil {
+		r.subscribers = make(map[*configSubscriber]struct{})
+	}
+	r.subscribers[s] = struct{}{}
+	go r.serveSubscriber(ctx, s)
+	return s.ch
+}
+
+func (r *AferoRepo) serveSubscriber(ctx context.Context, s *configSubscriber) {
+	defer func() {
+		packageLock.Lock()
+		delete(r.subscribers, s)
+		packageLock.Unlock()
+		close(s.ch)
+	}()
+
+	for {
+		c, ok := s.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.closing:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.closing:
+			return
+		case s.ch <- c:
+		}
+	}
+}
+
+// notifyConfigUnsynced sends the change from old to updated to the
+// subscribers, if any key changed.
+func (r *AferoRepo) notifyConfigUnsynced(old, updated *config.Config, external bool) {
+	if len(r.subscribers) == 0 || old == nil {
+		return
+	}
+	keys, err := changedConfigKeys(old, updated)
+	if err != nil {
+		log.Warnf("not notifying config change: %v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	c := ConfigChange{Old: old, New: updated, Keys: keys, External: external}
+	for s := range r.subscribers {
+		s.push(c)
+	}
+}
+
+// changedConfigKeys returns the sorted paths of the keys which differ between
+// the configs a and b.
+func changedConfigKeys(a, b *config.Config) ([]string, error) {
+	am, err := config.ToMap(a)
+	if err != nil {
+		return nil, err
+	}
+	bm, err := config.ToMap(b)
+	if err != nil {
+		return nil, err
+	}
+	keys := diffConfigMaps("", am, bm, nil)
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func diffConfigMaps(prefix string, a, b map[string]interface{}, keys []string) []string {
+	for k, av := range a {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+
+		bv, ok := b[k]
+		am, aIsMap := av.(map[string]interface{})
+		bm, bIsMap := bv.(map[string]interface{})
+		switch {
+		case ok && aIsMap && bIsMap:
+			keys = diffConfigMaps(path, am, bm, keys)
+		case !ok || !reflect.DeepEqual(av, bv):
+			keys = append(keys, path)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// stampConfigUnsynced records the hash of the config file written or read by
+// the repo, so the poller can tell the modifications made outside of the
+// repo.
+func (r *AferoRepo) stampConfigUnsynced() error {
+	configFilename, err := config.Filename(r.path)
+	if err != nil {
+		return err
+	}
+	buf, err := afero.ReadFile(r.fs, configFilename)
+	if err != nil {
+		return err
+	}
+	r.configHash = sha256.Sum256(buf)
+	return nil
+}
+
+// pollConfig reloads the config file every interval when it is modified
+// outside of the repo, until the repo is closed.
+func (r *AferoRepo) pollConfig(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closing:
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.reloadConfig(); err != nil {
+			log.Errorf("not reloading config: %v", err)
+		}
+	}
+}
+
+// reloadConfig reloads the config file if it was modified since the last
+// time it was read or written by the repo, and is valid. An invalid config is
+// only reported once.
+func (r *AferoRepo) reloadConfig() error {
+	packageLock.Lock()
+	defer packageLock.Unlock()
+	if r.closed {
+		return nil
+	}
+
+	configFilename, err := config.Filename(r.path)
+	if err != nil {
+		return err
+	}
+	// always hashed, a modification keeping the size of the file can keep
+	// its modification time on filesystems with a coarse resolution
+	buf, err := afero.ReadFile(r.fs, configFilename)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(buf)
+	if hash == r.configHash {
+		return nil
+	}
+	r.configHash = hash
+
+	updated, err := r.validateConfigUnsynced(buf)
+	if err != nil {
+		return err
+	}
+	old := r.config
+	r.config = updated
+	r.notifyConfigUnsynced(old, updated, true)
+	return nil
+}
+
+// validateConfigUnsynced decodes a config modified outside of the repo,
+// checking it can replace the current config.
+func (r *AferoRepo) validateConfigUnsynced(buf []byte) (*config.Config, error) {
+	var mapconf map[string]interface{}
+	if err := json.NewDecoder(bytes.NewReader(buf)).Decode(&mapconf); err != nil {
+		return nil, errors.Wrap(err, "decode config")
+	}
+	updated, err := config.FromMap(mapconf)
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.Identity.PeerID != r.config.Identity.PeerID {
+		return nil, ErrConfigIdentityChanged
+	}
+	if r.identityInKeystore {
+		updated.Identity.PrivKey = r.config.Identity.PrivKey
+	}
+
+	dsc, err := AnyDatastoreConfig(updated.Datastore.Spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "get datastore config")
+	}
+	current, err := AnyDatastoreConfig(r.config.Datastore.Spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "get datastore config")
+	}
+	if dsc.DiskSpec().String() != current.DiskSpec().String() {
+		return nil, ErrConfigDatastoreChanged
+	}
+	return updated, nil
+}
@@ -0,0 +1,127 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveConfigChange(t *testing.T, ch <-chan ConfigChange) ConfigChange {
+	t.Helper()
+	select {
+	case c, ok := <-ch:
+		require.True(t, ok, "the subscription was closed")
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config change received")
+	}
+	return ConfigChange{}
+}
+
+func TestSubscribe(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "subscribe", t)
+	require.NoError(t, Init(fs, path, &config.Config{Identity: testIdentity(t), Datastore: DefaultDatastoreConfig()}))
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	ar, ok := r.(ConfigSubscriber)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := ar.Subscribe(ctx)
+
+	require.NoError(t, r.SetConfigKey("Addresses.API", []string{"/ip4/127.0.0.1/tcp/5001"}))
+	cfg, err := r.Config()
+	require.NoError(t, err)
+	updated := *cfg
+	updated.Datastore.StorageMax = "20GB"
+	updated.Addresses.Gateway = []string{"/ip4/127.0.0.1/tcp/8080"}
+	require.NoError(t, r.SetConfig(&updated))
+	// no change, no notification
+	require.NoError(t, r.SetConfig(&updated))
+
+	c := receiveConfigChange(t, changes)
+	require.Equal(t, []string{"Addresses.API"}, c.Keys)
+	require.Empty(t, c.Old.Addresses.API)
+	require.Equal(t, []string{"/ip4/127.0.0.1/tcp/5001"}, []string(c.New.Addresses.API))
+	require.False(t, c.External)
+
+	c = receiveConfigChange(t, changes)
+	require.Equal(t, []string{"Addresses.Gateway", "Datastore.StorageMax"}, c.Keys)
+	require.Equal(t, "10GB", c.Old.Datastore.StorageMax)
+	require.Equal(t, "20GB", c.New.Datastore.StorageMax)
+
+	cancel()
+	for range changes {
+	}
+
+	// closing the repo ends the subscriptions
+	changes = ar.Subscribe(context.Background())
+	require.NoError(t, r.Close())
+	for range changes {
+	}
+	_, ok = <-ar.Subscribe(context.Background())
+	require.False(t, ok)
+}
+
+func TestConfigPoll(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "poll", t)
+	identity := testIdentity(t)
+	require.NoError(t, Init(fs, path, &config.Config{Identity: identity, Datastore: DefaultDatastoreConfig()}))
+	r, err := OpenWithOptions(fs, path, OpenOptions{ConfigPollInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer r.Close()
+	ar, ok := r.(ConfigSubscriber)
+	require.True(t, ok)
+	changes := ar.Subscribe(context.Background())
+
+	configFilename, err := config.Filename(path)
+	require.NoError(t, err)
+	edit := func(key string, value interface{}) {
+		var mapconf map[string]interface{}
+		require.NoError(t, ReadConfigFile(fs, configFilename, &mapconf))
+		mapconf[key] = value
+		require.NoError(t, WriteConfigFile(fs, configFilename, mapconf))
+	}
+
+	// changes made through the repo are not reported as external
+	require.NoError(t, r.SetConfigKey("Datastore.StorageMax", "20GB"))
+	c := receiveConfigChange(t, changes)
+	require.False(t, c.External)
+
+	edit("Routing", map[string]interface{}{"Type": "dhtclient"})
+	c = receiveConfigChange(t, changes)
+	require.True(t, c.External)
+	require.Equal(t, []string{"Routing.Type"}, c.Keys)
+	cfg, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, "dhtclient", cfg.Routing.Type)
+
+	// a modification keeping the size and the modification time of the file
+	st, err := fs.Stat(configFilename)
+	require.NoError(t, err)
+	edit("Routing", map[string]interface{}{"Type": "dhtserver"})
+	require.NoError(t, fs.Chtimes(configFilename, st.ModTime(), st.ModTime()))
+	c = receiveConfigChange(t, changes)
+	require.Equal(t, []string{"Routing.Type"}, c.Keys)
+
+	// invalid changes are not reloaded
+	edit("Identity", map[string]interface{}{"PeerID": "QmSomeoneElse", "PrivKey": identity.PrivKey})
+	time.Sleep(50 * time.Millisecond)
+	edit("Identity", map[string]interface{}{"PeerID": identity.PeerID, "PrivKey": identity.PrivKey})
+	edit("Datastore", map[string]interface{}{"StorageMax": "20GB", "Spec": map[string]interface{}{"type": "afero", "path": "other"}})
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected config change %v", c.Keys)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cfg, err = r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity.PeerID, cfg.Identity.PeerID)
+	require.Equal(t, "20GB", cfg.Datastore.StorageMax)
+}
@@ -3,19 +3,22 @@ package repo
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
 	"github.com/ipfs/go-ipfs/repo"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/mount"
-	dsq "github.com/ipfs/go-datastore/query"
 	measure "github.com/ipfs/go-ds-measure"
 )
 
@@ -31,8 +34,9 @@ type DatastoreConfig interface {
 	// excluded.
 	DiskSpec() DiskSpec
 
-	// Create instantiate a new datastore from this config
-	Create(path string) (repo.Datastore, error)
+	// Create instantiate a new datastore from this config, storing its data
+	// on fs under the repo path
+	Create(fs afero.Fs, path string) (repo.Datastore, error)
 }
 
 // DiskSpec is a minimal representation of the characteristic values of the
@@ -62,10 +66,12 @@ var datastores map[string]ConfigFromMap
 
 func init() {
 	datastores = map[string]ConfigFromMap{
-		"mount":   MountDatastoreConfig,
-		"log":     LogDatastoreConfig,
-		"measure": MeasureDatastoreConfig,
-		"afero":   AferoDatastoreConfig,
+		"mount":     MountDatastoreConfig,
+		"log":       LogDatastoreConfig,
+		"measure":   MeasureDatastoreConfig,
+		"afero":     AferoDatastoreConfig,
+		"quota":     QuotaDatastoreConfig,
+		"encrypted": EncryptedDatastoreConfig,
 	}
 }
 
@@ -153,17 +159,25 @@ func (c *mountDatastoreConfig) DiskSpec() DiskSpec {
 	return cfg
 }
 
-func (c *mountDatastoreConfig) Create(path string) (repo.Datastore, error) {
+func (c *mountDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
 	mounts := make([]mount.Mount, len(c.mounts))
 	for i, m := range c.mounts {
-		ds, err := m.ds.Create(path)
+		ds, err := m.ds.Create(fs, path)
 		if err != nil {
 			return nil, err
 		}
 		mounts[i].Datastore = ds
 		mounts[i].Prefix = m.prefix
 	}
-	return mount.New(mounts), nil
+
+	d := mount.New(mounts)
+	for _, m := range mounts {
+		if _, ok := m.Datastore.(ds.TxnDatastore); !ok {
+			return d, nil
+		}
+	}
+	// c.mounts is already sorted the same way mount.New sorts its mounts
+	return &mountTxnDatastore{Datastore: d, mounts: mounts}, nil
 }
 
 type logDatastoreConfig struct {
@@ -189,12 +203,12 @@ func LogDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error)
 
 }
 
-func (c *logDatastoreConfig) Create(path string) (repo.Datastore, error) {
-	child, err := c.child.Create(path)
+func (c *logDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	child, err := c.child.Create(fs, path)
 	if err != nil {
 		return nil, err
 	}
-	return ds.NewLogDatastore(child, c.name), nil
+	return withTxn(ds.NewLogDatastore(child, c.name), child), nil
 }
 
 func (c *logDatastoreConfig) DiskSpec() DiskSpec {
@@ -227,22 +241,31 @@ func (c *measureDatastoreConfig) DiskSpec() DiskSpec {
 	return c.child.DiskSpec()
 }
 
-func (c measureDatastoreConfig) Create(path string) (repo.Datastore, error) {
-	child, err := c.child.Create(path)
+func (c measureDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	child, err := c.child.Create(fs, path)
 	if err != nil {
 		return nil, err
 	}
-	return measure.New(c.prefix, child), nil
+	return withTxn(measure.New(c.prefix, child), child), nil
 }
 
 type aferoDatastoreConfig struct {
-	path string
+	path      string
+	shardFunc *ShardIdV1
+	sync      bool
 }
 
 var _ DatastoreConfig = (*aferoDatastoreConfig)(nil)
 
+// DsFs is the filesystem used by afero datastores created without one.
+//
+// Deprecated: the repo filesystem is passed to DatastoreConfig.Create.
 var DsFs afero.Fs
 
+// ErrNoFs is returned when creating a datastore without a filesystem while
+// DsFs is not set either.
+var ErrNoFs = errors.New("no filesystem to create the datastore on")
+
 // AferoDatastoreConfig returns an afero DatastoreConfig from a spec
 func AferoDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
 	pp, ok := params["path"]
@@ -255,52 +278,220 @@ func AferoDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error
 		return nil, errors.New("path is not a string")
 	}
 
+	var shardFunc *ShardIdV1
+	if sf, ok := params["shardFunc"]; ok {
+		sfs, ok := sf.(string)
+		if !ok {
+			return nil, errors.New("shardFunc is not a string")
+		}
+
+		var err error
+		shardFunc, err = ParseShardFunc(sfs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sync bool
+	if sv, ok := params["sync"]; ok {
+		sync, ok = sv.(bool)
+		if !ok {
+			return nil, errors.New("sync is not a boolean")
+		}
+	}
+
 	return &aferoDatastoreConfig{
-		path: p,
+		path:      p,
+		shardFunc: shardFunc,
+		sync:      sync,
 	}, nil
 }
 
-func (dsc *aferoDatastoreConfig) Create(path string) (repo.Datastore, error) {
-	return &aferoDatastore{fs: DsFs, path: path + "/" + dsc.path}, nil
+func (dsc *aferoDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	if fs == nil {
+		fs = DsFs
+	}
+	if fs == nil {
+		return nil, ErrNoFs
+	}
+	return newAferoDatastore(fs, path+"/"+dsc.path, dsc)
 }
 
 func (dsc *aferoDatastoreConfig) DiskSpec() DiskSpec {
-	return map[string]interface{}{
+	spec := map[string]interface{}{
 		"type": "afero",
 		"path": dsc.path,
 	}
+	if dsc.shardFunc != nil {
+		spec["shardFunc"] = dsc.shardFunc.String()
+	}
+	return spec
 }
 
 // Afero version of https://github.com/ipfs/go-datastore/blob/master/examples/fs.go
 
 type aferoDatastore struct {
-	fs     afero.Fs
-	path   string
-	closed bool
+	fs    afero.Fs
+	path  string
+	shard ShardFunc
+	sync  bool
+
+	// closed is set by Close, accessed atomically
+	closed int32
+
+	// readOnly is set when the datastore is opened through a read-only
+	// filesystem, writes then fail with ErrReadOnly
+	readOnly bool
+
+	// txnLock is held exclusively while a transaction begins or commits and
+	// shared by every other write
+	txnLock sync.RWMutex
+	txns    txnTracker
+
+	// keyLocks serialize the writes to a key, so the size of the object they
+	// replace is not read by two writers at once
+	keyLocks [keyLockCount]sync.Mutex
+
+	// journalLock serializes the replays of the batch journals, pending
+	// holds the committed journals whose replay failed
+	journalLock sync.Mutex
+	pending     []string
+
+	// diskUsage is the size of the stored objects, accessed atomically
+	diskUsage int64
 }
 
 var _ repo.Datastore = (*aferoDatastore)(nil)
 
-func (ads *aferoDatastore) Batch() (ds.Batch, error) {
-	return ds.NewBasicBatch(ads), nil
+// newAferoDatastore opens the datastore at path, refusing to open it if the
+// shard function persisted on disk differs from the configured one.
+func newAferoDatastore(fs afero.Fs, path string, dsc *aferoDatastoreConfig) (*aferoDatastore, error) {
+	ads := &aferoDatastore{fs: fs, path: path, sync: dsc.sync, readOnly: isReadOnlyFs(fs)}
+	shardFunc := dsc.shardFunc
+
+	onDisk, err := readShardFunc(fs, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read shard func")
+	}
+
+	switch {
+	case onDisk == nil && shardFunc == nil:
+	case onDisk == nil && ads.readOnly:
+		// nothing was ever written, the configured shard func is used as is
+	case onDisk == nil:
+		// like flatfs, an existing datastore is never sharded afterwards, its
+		// objects would not be found anymore
+		empty, err := isEmptyDir(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, fmt.Errorf("datastore at '%s' is not sharded, it can't be opened with shard func '%s'", path, shardFunc)
+		}
+		if err := fs.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		if err := writeShardFunc(fs, path, shardFunc); err != nil {
+			return nil, errors.Wrap(err, "write shard func")
+		}
+	case shardFunc == nil:
+		return nil, fmt.Errorf("datastore at '%s' is sharded with '%s' but no shard func was specified", path, onDisk)
+	case onDisk.String() != shardFunc.String():
+		return nil, fmt.Errorf("specified shard func '%s' does not match repo shard func '%s'", shardFunc, onDisk)
+	}
+
+	if shardFunc != nil {
+		ads.shard = shardFunc.Func()
+	}
+
+	// a read-only datastore leaves the crash recovery to the next writer, and
+	// doesn't see the batches still pending in the journal until then
+	if !ads.readOnly {
+		if err := ads.recoverJournals(); err != nil {
+			return nil, errors.Wrap(err, "recover journals")
+		}
+
+		if err := ads.removeTempFiles(); err != nil {
+			return nil, errors.Wrap(err, "remove temp files")
+		}
+	}
+
+	if err := ads.loadDiskUsage(); err != nil {
+		return nil, errors.Wrap(err, "load disk usage")
+	}
+
+	return ads, nil
 }
 
+// Close persists the disk usage cache once the writes in progress are done.
+// Any later use of the datastore fails with ErrClosed.
 func (ads *aferoDatastore) Close() error {
-	//ads.closed = true
-	return nil
+	ads.txnLock.Lock()
+	defer ads.txnLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&ads.closed, 0, 1) {
+		return nil
+	}
+	if ads.readOnly {
+		return nil
+	}
+	return ads.persistDiskUsage()
+}
+
+func (ads *aferoDatastore) isClosed() bool {
+	return atomic.LoadInt32(&ads.closed) != 0
+}
+
+const keyLockCount = 64
+
+// lockKey locks the writes to key and returns the unlock func. A writer never
+// holds more than one key lock at once.
+func (ads *aferoDatastore) lockKey(key ds.Key) func() {
+	h := fnv.New32a()
+	h.Write(key.Bytes())
+	mu := &ads.keyLocks[h.Sum32()%keyLockCount]
+	mu.Lock()
+	return mu.Unlock
 }
 
 func (ads *aferoDatastore) Delete(key ds.Key) (err error) {
+	if ads.readOnly {
+		return ErrReadOnly
+	}
+	if err := ads.checkKey(key); err != nil {
+		return err
+	}
+
+	ads.txnLock.RLock()
+	defer ads.txnLock.RUnlock()
+
+	if ads.isClosed() {
+		return ErrClosed
+	}
+	if err := ads.replayPending(); err != nil {
+		return err
+	}
+
+	defer ads.lockKey(key)()
+
 	fn := ads.KeyFilename(key)
 	if !isFile(ads.fs, fn) {
 		return nil
 	}
 
+	if err := ads.recordWrite(key, fn); err != nil {
+		return err
+	}
+	size := ads.objectSize(fn)
 	err = ads.fs.Remove(fn)
 	if os.IsNotExist(err) {
-		err = nil // idempotent
+		return nil // idempotent
+	} else if err != nil {
+		return err
 	}
-	return err
+
+	ads.updateDiskUsage(-size)
+	return nil
 }
 
 var ErrClosed = errors.New("datastore is closed")
@@ -310,7 +501,7 @@ func (ads *aferoDatastore) Get(key ds.Key) ([]byte, error) {
 }
 
 func (ads *aferoDatastore) get(key ds.Key) ([]byte, error) {
-	if ads.closed {
+	if ads.isClosed() {
 		return nil, ErrClosed
 	}
 
@@ -341,6 +532,25 @@ func (ads *aferoDatastore) Has(key ds.Key) (bool, error) {
 }
 
 func (ads *aferoDatastore) Put(key ds.Key, value []byte) (err error) {
+	if ads.readOnly {
+		return ErrReadOnly
+	}
+	if err := ads.checkKey(key); err != nil {
+		return err
+	}
+
+	ads.txnLock.RLock()
+	defer ads.txnLock.RUnlock()
+
+	if ads.isClosed() {
+		return ErrClosed
+	}
+	if err := ads.replayPending(); err != nil {
+		return err
+	}
+
+	defer ads.lockKey(key)()
+
 	fn := ads.KeyFilename(key)
 
 	// mkdirall above.
@@ -349,51 +559,76 @@ func (ads *aferoDatastore) Put(key ds.Key, value []byte) (err error) {
 		return err
 	}
 
-	return afero.WriteFile(ads.fs, fn, value, 0666)
-}
+	if err := ads.recordWrite(key, fn); err != nil {
+		return err
+	}
+	oldSize := ads.objectSize(fn)
 
-var ObjectKeySuffix = ".dsobject"
+	// write to a temp file renamed on close so a crash never leaves a
+	// truncated object behind
+	var opts []atomicfile.Option
+	if ads.sync {
+		opts = append(opts, atomicfile.SyncFile(), atomicfile.SyncDir())
+	}
+	f, err := atomicfile.New(ads.fs, fn, 0644, opts...)
+	if err != nil {
+		return err
+	}
 
-func (ads *aferoDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	if _, err := f.Write(value); err != nil {
+		f.Abort()
+		return err
+	}
 
-	entries := []dsq.Entry{}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	ads.updateDiskUsage(int64(len(value)) - oldSize)
+	return nil
+}
 
-	walkFn := func(path string, info os.FileInfo, _ error) error {
-		// remove ds path prefix
-		relPath, err := filepath.Rel(ads.path, path)
-		if err == nil {
-			path = filepath.ToSlash(relPath)
-		}
+var ObjectKeySuffix = ".dsobject"
 
-		if info != nil && !info.IsDir() {
-			path = strings.TrimSuffix(path, ObjectKeySuffix)
-			var result dsq.Entry
-			key := ds.NewKey(path)
-			result.Key = key.String()
-			if !q.KeysOnly {
-				result.Value, err = ads.get(key)
-				if err != nil {
-					return err
-				}
-			}
-			entries = append(entries, result)
-		}
-		return nil
+// isTempObjectFile returns whether name is an atomicfile temp file of an
+// object, those are named after the object followed by random digits.
+func isTempObjectFile(name string) bool {
+	i := strings.LastIndex(name, ObjectKeySuffix)
+	if i < 0 || i+len(ObjectKeySuffix) == len(name) {
+		return false
 	}
-
-	if err := afero.Walk(ads.fs, ads.path, walkFn); err != nil {
-		return nil, err
+	for _, c := range name[i+len(ObjectKeySuffix):] {
+		if c < '0' || c > '9' {
+			return false
+		}
 	}
-
-	r := dsq.ResultsWithEntries(q, entries)
-	r = dsq.NaiveQueryApply(q, r)
-	return r, nil
+	return true
 }
 
 func (ads *aferoDatastore) Sync(ds.Key) error {
 	return nil
 }
 
+// removeTempFiles deletes the temp files left by writes interrupted by a crash.
+func (ads *aferoDatastore) removeTempFiles() error {
+	exists, err := afero.DirExists(ads.fs, ads.path)
+	if err != nil || !exists {
+		return err
+	}
+
+	return afero.Walk(ads.fs, ads.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return ignoreNotExist(err)
+		}
+		if info.IsDir() || !isTempObjectFile(info.Name()) {
+			return nil
+		}
+		return ignoreNotExist(ads.fs.Remove(path))
+	})
+}
+
 func (ads *aferoDatastore) KeyFilename(key ds.Key) string {
-	return filepath.Join(ads.path, key.String()+ObjectKeySuffix)
+	if ads.shard == nil {
+		return filepath.Join(ads.path, key.String()+ObjectKeySuffix)
+	}
+	return filepath.Join(ads.path, ads.shard(key.BaseNamespace()), key.String()+ObjectKeySuffix)
 }
@@ -0,0 +1,279 @@
+package repo
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShardFunc(t *testing.T) {
+	for _, id := range []string{
+		"/repo/flatfs/shard/v1/prefix/2",
+		"/repo/flatfs/shard/v1/suffix/3",
+		"/repo/flatfs/shard/v1/next-to-last/2",
+	} {
+		sf, err := ParseShardFunc(id)
+		require.NoError(t, err)
+		require.Equal(t, id, sf.String())
+	}
+
+	for _, id := range []string{
+		"",
+		"/repo/flatfs/shard/v2/prefix/2",
+		"/repo/flatfs/shard/v1/middle/2",
+		"/repo/flatfs/shard/v1/prefix/0",
+		"prefix/2",
+	} {
+		_, err := ParseShardFunc(id)
+		require.Error(t, err, id)
+	}
+
+	require.Equal(t, "AB", ShardPrefix(2).Func()("ABCD"))
+	require.Equal(t, "CD", ShardSuffix(2).Func()("ABCD"))
+	require.Equal(t, "BC", ShardNextToLast(2).Func()("ABCD"))
+	require.Equal(t, "__", ShardNextToLast(2).Func()("A"))
+}
+
+func TestAferoDatastoreSharding(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	dsc, err := AferoDatastoreConfig(map[string]interface{}{
+		"type":      "afero",
+		"path":      "blocks",
+		"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/repo/flatfs/shard/v1/next-to-last/2", dsc.DiskSpec()["shardFunc"])
+
+	d, err := newAferoDatastore(fs, "/repo/blocks", dsc.(*aferoDatastoreConfig))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Put(ds.NewKey("/CIQABCD"), []byte("block")))
+	exists, err := afero.Exists(fs, filepath.Join("/repo/blocks", "BC", "CIQABCD"+ObjectKeySuffix))
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	res, err := d.Query(dsq.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/CIQABCD", entries[0].Key)
+	require.Equal(t, []byte("block"), entries[0].Value)
+
+	other, err := AferoDatastoreConfig(map[string]interface{}{
+		"type":      "afero",
+		"path":      "blocks",
+		"shardFunc": "/repo/flatfs/shard/v1/prefix/2",
+	})
+	require.NoError(t, err)
+	_, err = newAferoDatastore(fs, "/repo/blocks", other.(*aferoDatastoreConfig))
+	require.Error(t, err)
+
+	unsharded, err := AferoDatastoreConfig(map[string]interface{}{
+		"type": "afero",
+		"path": "blocks",
+	})
+	require.NoError(t, err)
+	_, err = newAferoDatastore(fs, "/repo/blocks", unsharded.(*aferoDatastoreConfig))
+	require.Error(t, err)
+
+	// an existing unsharded datastore is not sharded afterwards
+	d, err = newAferoDatastore(fs, "/repo/flat", unsharded.(*aferoDatastoreConfig))
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ds.NewKey("/CIQABCD"), []byte("block")))
+	_, err = newAferoDatastore(fs, "/repo/flat", dsc.(*aferoDatastoreConfig))
+	require.Error(t, err)
+	exists, err = afero.Exists(fs, filepath.Join("/repo/flat", shardingFn))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestAferoDatastoreQuery(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/repo/datastore", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	for _, k := range []string{"/pins/a", "/pins/b", "/pins/c", "/pinsx", "/other/d"} {
+		require.NoError(t, d.Put(ds.NewKey(k), []byte(k)))
+	}
+
+	keys := func(q dsq.Query) []string {
+		t.Helper()
+
+		res, err := d.Query(q)
+		require.NoError(t, err)
+		entries, err := res.Rest()
+		require.NoError(t, err)
+
+		keys := make([]string, len(entries))
+		for i, e := range entries {
+			if q.KeysOnly {
+				require.Nil(t, e.Value)
+			} else {
+				require.Equal(t, e.Key, string(e.Value))
+			}
+			keys[i] = e.Key
+		}
+		return keys
+	}
+
+	require.Equal(t, []string{"/pins/a", "/pins/b", "/pins/c"}, keys(dsq.Query{Prefix: "/pins"}))
+	require.Equal(t, []string{"/pins/a", "/pins/b", "/pins/c"}, keys(dsq.Query{Prefix: "/pins/", KeysOnly: true}))
+	require.Empty(t, keys(dsq.Query{Prefix: "/missing"}))
+	require.Len(t, keys(dsq.Query{}), 5)
+	require.Equal(t, []string{"/pins/b"}, keys(dsq.Query{Prefix: "/pins", Offset: 1, Limit: 1}))
+	require.Equal(t, []string{"/pins/c", "/pins/b"}, keys(dsq.Query{
+		Prefix: "/pins",
+		Orders: []dsq.Order{dsq.OrderByKeyDescending{}},
+		Limit:  2,
+	}))
+	require.Equal(t, []string{"/pins/b"}, keys(dsq.Query{
+		Prefix:  "/pins",
+		Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("/pins/b")}},
+	}))
+
+	// closing early stops the walk
+	cfs := &countingFs{Fs: afero.NewMemMapFs()}
+	d, err = newAferoDatastore(cfs, "/repo/datastore", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, d.Put(ds.NewKey(fmt.Sprintf("/k%d", i)), []byte("v")))
+	}
+	res, err := d.Query(dsq.Query{})
+	require.NoError(t, err)
+	_, ok := res.NextSync()
+	require.True(t, ok)
+	require.NoError(t, res.Close())
+	// the walk is done once closed, it read at most the values of the
+	// received entry, the buffered ones and the one waiting to be sent
+	visited := atomic.LoadInt64(&cfs.objectOpens)
+	require.LessOrEqual(t, visited, int64(dsq.NormalBufSize+2))
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, visited, atomic.LoadInt64(&cfs.objectOpens))
+}
+
+// countingFs counts the opens of the object files.
+type countingFs struct {
+	afero.Fs
+	objectOpens int64
+}
+
+func (fs *countingFs) Open(name string) (afero.File, error) {
+	if strings.HasSuffix(name, ObjectKeySuffix) {
+		atomic.AddInt64(&fs.objectOpens, 1)
+	}
+	return fs.Fs.Open(name)
+}
+
+func TestAferoDatastorePutRemovesTempFiles(t *testing.T) {
+	fs := afero.NewOsFs()
+	path := filepath.Join(t.TempDir(), "datastore")
+
+	d, err := newAferoDatastore(fs, path, &aferoDatastoreConfig{sync: true})
+	require.NoError(t, err)
+
+	require.NoError(t, d.Put(ds.NewKey("/a/b"), []byte("value")))
+	value, err := d.Get(ds.NewKey("/a/b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// simulate a write interrupted by a crash
+	orphan := filepath.Join(path, "a", "c"+ObjectKeySuffix+"123456")
+	require.NoError(t, afero.WriteFile(fs, orphan, []byte("val"), 0644))
+
+	_, err = newAferoDatastore(fs, path, &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	exists, err := afero.Exists(fs, orphan)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	value, err = d.Get(ds.NewKey("/a/b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestAferoDatastoreDiskUsage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dsc := &aferoDatastoreConfig{shardFunc: ShardNextToLast(2)}
+
+	d, err := newAferoDatastore(fs, "/ds", dsc)
+	require.NoError(t, err)
+
+	diskUsage := func(d *aferoDatastore) uint64 {
+		t.Helper()
+		du, err := ds.DiskUsage(d)
+		require.NoError(t, err)
+		return du
+	}
+
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("1234")))
+	require.NoError(t, d.Put(ds.NewKey("/b"), []byte("12")))
+	require.Equal(t, uint64(6), diskUsage(d))
+
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("1")))
+	require.NoError(t, d.Delete(ds.NewKey("/b")))
+	require.Equal(t, uint64(1), diskUsage(d))
+
+	b, err := d.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ds.NewKey("/c"), []byte("123")))
+	require.NoError(t, b.Delete(ds.NewKey("/a")))
+	require.NoError(t, b.Commit())
+	require.Equal(t, uint64(3), diskUsage(d))
+
+	// the cache is used when the datastore was closed
+	require.NoError(t, d.Close())
+	require.NoError(t, afero.WriteFile(fs, "/ds/extra"+ObjectKeySuffix, []byte("untracked"), 0644))
+	d, err = newAferoDatastore(fs, "/ds", dsc)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), diskUsage(d))
+
+	// and recomputed when it wasn't
+	d, err = newAferoDatastore(fs, "/ds", dsc)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3+len("untracked")), diskUsage(d))
+}
+
+func TestAferoDatastoreConcurrentPuts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/ds", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	// every put replaces the object of the others, the usage must still
+	// match the stored object
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			require.NoError(t, d.Put(ds.NewKey("/a"), make([]byte, size)))
+		}(i)
+	}
+	wg.Wait()
+
+	du, err := ds.DiskUsage(d)
+	require.NoError(t, err)
+	walked, err := d.walkDiskUsage()
+	require.NoError(t, err)
+	require.Equal(t, uint64(walked), du)
+
+	require.NoError(t, d.Close())
+	require.NoError(t, d.Close())
+	require.Equal(t, ErrClosed, d.Put(ds.NewKey("/b"), []byte("b")))
+	require.Equal(t, ErrClosed, d.Delete(ds.NewKey("/a")))
+	_, err = d.Get(ds.NewKey("/a"))
+	require.Equal(t, ErrClosed, err)
+}
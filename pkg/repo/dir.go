@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/spf13/afero"
 )
@@ -23,3 +24,9 @@ func Writable(fs afero.Fs, path string) error {
 	}
 	return nil
 }
+
+// unwritable reports whether err is caused by a directory which can't be
+// written to, such as a read-only filesystem.
+func unwritable(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/spf13/afero"
+)
+
+// The disk usage is maintained in memory and persisted in a cache file when
+// the datastore is closed. The cache is removed once loaded, so a datastore
+// which was not closed properly has its disk usage recomputed.
+const diskUsageCacheFn = "diskUsage.cache"
+
+type diskUsageCache struct {
+	DiskUsage int64 `json:"diskUsage"`
+}
+
+var _ ds.PersistentDatastore = (*aferoDatastore)(nil)
+
+// DiskUsage returns the size of the objects stored in the datastore.
+func (ads *aferoDatastore) DiskUsage() (uint64, error) {
+	du := atomic.LoadInt64(&ads.diskUsage)
+	if du < 0 {
+		return 0, nil
+	}
+	return uint64(du), nil
+}
+
+func (ads *aferoDatastore) updateDiskUsage(delta int64) {
+	atomic.AddInt64(&ads.diskUsage, delta)
+}
+
+// objectSize returns the size of the object file fn, or 0 if it doesn't exist.
+func (ads *aferoDatastore) objectSize(fn string) int64 {
+	info, err := ads.fs.Stat(fn)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (ads *aferoDatastore) loadDiskUsage() error {
+	fn := filepath.Join(ads.path, diskUsageCacheFn)
+
+	buf, err := afero.ReadFile(ads.fs, fn)
+	if os.IsNotExist(err) {
+		// the datastore was not closed properly
+		return ads.recomputeDiskUsage()
+	} else if err != nil {
+		return err
+	}
+
+	// the cache is stale as soon as the datastore is written to
+	if !ads.readOnly {
+		if err := ads.fs.Remove(fn); err != nil {
+			return err
+		}
+	}
+
+	var cache diskUsageCache
+	if err := json.Unmarshal(buf, &cache); err != nil {
+		return ads.recomputeDiskUsage()
+	}
+	atomic.StoreInt64(&ads.diskUsage, cache.DiskUsage)
+	return nil
+}
+
+func (ads *aferoDatastore) recomputeDiskUsage() error {
+	du, err := ads.walkDiskUsage()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&ads.diskUsage, du)
+	return nil
+}
+
+// walkDiskUsage computes the disk usage by walking the whole datastore.
+func (ads *aferoDatastore) walkDiskUsage() (int64, error) {
+	exists, err := afero.DirExists(ads.fs, ads.path)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var du int64
+	err = afero.Walk(ads.fs, ads.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return ignoreNotExist(err)
+		}
+		if info.IsDir() {
+			if path == filepath.Join(ads.path, journalDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ObjectKeySuffix) {
+			du += info.Size()
+		}
+		return nil
+	})
+	return du, err
+}
+
+func (ads *aferoDatastore) persistDiskUsage() error {
+	buf, err := json.Marshal(&diskUsageCache{DiskUsage: atomic.LoadInt64(&ads.diskUsage)})
+	if err != nil {
+		return err
+	}
+
+	if err := ads.fs.MkdirAll(ads.path, 0755); err != nil {
+		return err
+	}
+
+	f, err := atomicfile.New(ads.fs, filepath.Join(ads.path, diskUsageCacheFn), 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
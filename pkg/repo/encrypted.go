@@ -0,0 +1,428 @@
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+	CipherAES256GCM         = "aes-256-gcm"
+
+	// EncryptionKeySize is the size of the keys returned by key providers.
+	EncryptionKeySize = 32
+)
+
+// ErrDecrypt is returned when a value of an encrypted datastore can't be
+// decrypted, because it is corrupted or was encrypted with another key.
+var ErrDecrypt = errors.New("failed to decrypt value")
+
+// KeyProvider returns the key of an encrypted datastore.
+type KeyProvider func() ([]byte, error)
+
+var keyProviders = map[string]KeyProvider{}
+
+// AddKeyProvider registers a key provider which encrypted datastores can refer
+// to by name in their spec, so the key is never stored in the config.
+func AddKeyProvider(name string, p KeyProvider) error {
+	_, ok := keyProviders[name]
+	if ok {
+		return fmt.Errorf("already have a key provider named %q", name)
+	}
+
+	keyProviders[name] = p
+	return nil
+}
+
+type encryptedDatastoreConfig struct {
+	child       DatastoreConfig
+	cipher      string
+	encryptKeys bool
+	key         []byte
+}
+
+// EncryptedDatastoreConfig returns an encrypted DatastoreConfig from a spec
+func EncryptedDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+
+	providerName, ok := params["keyProvider"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'keyProvider' field is missing or not a string")
+	}
+	provider, ok := keyProviders[providerName]
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider: %q", providerName)
+	}
+	key, err := provider()
+	if err != nil {
+		return nil, errors.Wrapf(err, "get key from provider %q", providerName)
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("key provider %q returned a %d bytes key, expected %d", providerName, len(key), EncryptionKeySize)
+	}
+
+	c := CipherXChaCha20Poly1305
+	if cv, ok := params["cipher"]; ok {
+		c, ok = cv.(string)
+		if !ok {
+			return nil, fmt.Errorf("'cipher' field is not a string")
+		}
+	}
+	if _, err := newAEAD(c, key); err != nil {
+		return nil, err
+	}
+
+	var encryptKeys bool
+	if ev, ok := params["encryptKeys"]; ok {
+		encryptKeys, ok = ev.(bool)
+		if !ok {
+			return nil, fmt.Errorf("'encryptKeys' field is not a boolean")
+		}
+	}
+
+	return &encryptedDatastoreConfig{
+		child:       child,
+		cipher:      c,
+		encryptKeys: encryptKeys,
+		key:         key,
+	}, nil
+}
+
+// DiskSpec records the fingerprint of the key instead of the key, so opening
+// the datastore with another key fails.
+func (c *encryptedDatastoreConfig) DiskSpec() DiskSpec {
+	spec := map[string]interface{}{
+		"type":        "encrypted",
+		"cipher":      c.cipher,
+		"fingerprint": hex.EncodeToString(deriveKey(c.key, "fingerprint")[:8]),
+		"child":       map[string]interface{}(c.child.DiskSpec()),
+	}
+	if c.encryptKeys {
+		spec["encryptKeys"] = true
+	}
+	return spec
+}
+
+func (c *encryptedDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	child, err := c.child.Create(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(c.cipher, deriveKey(c.key, "value"))
+	if err != nil {
+		return nil, err
+	}
+	s := &sealer{aead: aead}
+	if c.encryptKeys {
+		s.nameKey = deriveKey(c.key, "name")
+	}
+
+	e := &encryptedDatastore{Datastore: child, s: s}
+	if txn, ok := child.(ds.TxnDatastore); ok {
+		return &encryptedTxnDatastore{encryptedDatastore: e, txn: txn}, nil
+	}
+	return e, nil
+}
+
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("unknown cipher: %q", name)
+}
+
+// deriveKey derives a subkey of key for the given purpose, so the key itself
+// is only used as input of the derivation.
+func deriveKey(key []byte, purpose string) []byte {
+	sub := make([]byte, EncryptionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(purpose)), sub); err != nil {
+		// should not happen, hkdf can output way more than that
+		panic(err)
+	}
+	return sub
+}
+
+// sealer encrypts the values of a datastore, authenticating them with the key
+// they are stored under so they can't be swapped. When key names are
+// encrypted, they are replaced by their HMAC and the key is stored with the
+// value so queries can recover it.
+type sealer struct {
+	aead    cipher.AEAD
+	nameKey []byte
+}
+
+func (s *sealer) storeKey(key ds.Key) ds.Key {
+	if s.nameKey == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, s.nameKey)
+	mac.Write(key.Bytes())
+	return ds.RawKey("/" + codec.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *sealer) seal(key ds.Key, value []byte) ([]byte, error) {
+	payload := value
+	if s.nameKey != nil {
+		var l [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(l[:], uint64(len(key.String())))
+		payload = make([]byte, 0, n+len(key.String())+len(value))
+		payload = append(payload, l[:n]...)
+		payload = append(payload, key.String()...)
+		payload = append(payload, value...)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(payload)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, payload, s.storeKey(key).Bytes()), nil
+}
+
+// open decrypts a value stored under sk, returning its key and value.
+func (s *sealer) open(sk ds.Key, sealed []byte) (ds.Key, []byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return ds.Key{}, nil, errors.Wrapf(ErrDecrypt, "key %s", sk)
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	payload, err := s.aead.Open(nil, nonce, ciphertext, sk.Bytes())
+	if err != nil {
+		return ds.Key{}, nil, errors.Wrapf(ErrDecrypt, "key %s", sk)
+	}
+
+	if s.nameKey == nil {
+		return sk, payload, nil
+	}
+	l, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < l {
+		return ds.Key{}, nil, errors.Wrapf(ErrDecrypt, "key %s: invalid payload", sk)
+	}
+	return ds.RawKey(string(payload[n : n+int(l)])), payload[n+int(l):], nil
+}
+
+// overhead is the difference between the size of a sealed value and its size.
+func (s *sealer) overhead(key ds.Key) int {
+	o := s.aead.NonceSize() + s.aead.Overhead()
+	if s.nameKey != nil {
+		var buf [binary.MaxVarintLen64]byte
+		o += binary.PutUvarint(buf[:], uint64(len(key.String()))) + len(key.String())
+	}
+	return o
+}
+
+func (s *sealer) get(r ds.Read, key ds.Key) ([]byte, error) {
+	sk := s.storeKey(key)
+	sealed, err := r.Get(sk)
+	if err != nil {
+		return nil, err
+	}
+	_, value, err := s.open(sk, sealed)
+	return value, err
+}
+
+func (s *sealer) getSize(r ds.Read, key ds.Key) (int, error) {
+	size, err := r.GetSize(s.storeKey(key))
+	if err != nil {
+		return -1, err
+	}
+	return size - s.overhead(key), nil
+}
+
+func (s *sealer) put(w ds.Write, key ds.Key, value []byte) error {
+	sealed, err := s.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return w.Put(s.storeKey(key), sealed)
+}
+
+// query decrypts every value of r, then applies q to the decrypted entries.
+func (s *sealer) query(r ds.Read, q dsq.Query) (dsq.Results, error) {
+	var cq dsq.Query
+	if s.nameKey == nil {
+		cq.Prefix = q.Prefix
+	}
+	res, err := r.Query(cq)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			key, value, err := s.open(ds.RawKey(r.Key), r.Value)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			e := dsq.Entry{Key: key.String(), Size: len(value), Expiration: r.Expiration}
+			if !q.KeysOnly {
+				e.Value = value
+			}
+			return dsq.Result{Entry: e}, true
+		},
+		Close: res.Close,
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, iter)), nil
+}
+
+// encryptedDatastore encrypts the values, and optionally the keys, of its
+// child.
+type encryptedDatastore struct {
+	repo.Datastore
+	s *sealer
+}
+
+var _ ds.PersistentDatastore = (*encryptedDatastore)(nil)
+
+func (e *encryptedDatastore) Get(key ds.Key) ([]byte, error) {
+	return e.s.get(e.Datastore, key)
+}
+
+func (e *encryptedDatastore) Has(key ds.Key) (bool, error) {
+	return e.Datastore.Has(e.s.storeKey(key))
+}
+
+func (e *encryptedDatastore) GetSize(key ds.Key) (int, error) {
+	return e.s.getSize(e.Datastore, key)
+}
+
+func (e *encryptedDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	return e.s.query(e.Datastore, q)
+}
+
+func (e *encryptedDatastore) Put(key ds.Key, value []byte) error {
+	return e.s.put(e.Datastore, key, value)
+}
+
+func (e *encryptedDatastore) Delete(key ds.Key) error {
+	return e.Datastore.Delete(e.s.storeKey(key))
+}
+
+func (e *encryptedDatastore) Sync(prefix ds.Key) error {
+	if e.s.nameKey != nil {
+		// the prefix can't be mapped to the encrypted keys
+		prefix = ds.NewKey("/")
+	}
+	return e.Datastore.Sync(prefix)
+}
+
+func (e *encryptedDatastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(e.Datastore)
+}
+
+func (e *encryptedDatastore) Batch() (ds.Batch, error) {
+	b, err := e.Datastore.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBatch{Batch: b, s: e.s}, nil
+}
+
+type encryptedBatch struct {
+	ds.Batch
+	s *sealer
+}
+
+func (b *encryptedBatch) Put(key ds.Key, value []byte) error {
+	return b.s.put(b.Batch, key, value)
+}
+
+func (b *encryptedBatch) Delete(key ds.Key) error {
+	return b.Batch.Delete(b.s.storeKey(key))
+}
+
+type encryptedTxnDatastore struct {
+	*encryptedDatastore
+	txn ds.TxnDatastore
+}
+
+var (
+	_ ds.TxnDatastore = (*encryptedTxnDatastore)(nil)
+	_ txnBeginner     = (*encryptedTxnDatastore)(nil)
+)
+
+func (e *encryptedTxnDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	txn, err := e.txn.NewTransaction(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTxn{Txn: txn, s: e.s}, nil
+}
+
+func (e *encryptedTxnDatastore) txnLocker() sync.Locker {
+	return txnLockerOf(e.txn)
+}
+
+func (e *encryptedTxnDatastore) newTransactionLocked(readOnly bool) (ds.Txn, error) {
+	txn, err := e.txn.(txnBeginner).newTransactionLocked(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTxn{Txn: txn, s: e.s}, nil
+}
+
+type encryptedTxn struct {
+	ds.Txn
+	s *sealer
+}
+
+func (t *encryptedTxn) Get(key ds.Key) ([]byte, error) {
+	return t.s.get(t.Txn, key)
+}
+
+func (t *encryptedTxn) Has(key ds.Key) (bool, error) {
+	return t.Txn.Has(t.s.storeKey(key))
+}
+
+func (t *encryptedTxn) GetSize(key ds.Key) (int, error) {
+	return t.s.getSize(t.Txn, key)
+}
+
+func (t *encryptedTxn) Query(q dsq.Query) (dsq.Results, error) {
+	return t.s.query(t.Txn, q)
+}
+
+func (t *encryptedTxn) Put(key ds.Key, value []byte) error {
+	return t.s.put(t.Txn, key, value)
+}
+
+func (t *encryptedTxn) Delete(key ds.Key) error {
+	return t.Txn.Delete(t.s.storeKey(key))
+}
+
+func (t *encryptedTxn) prepare() (*preparedTxn, error) {
+	return prepareTxn(t.Txn)
+}
@@ -0,0 +1,149 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	for name, b := range map[string]byte{"test-a": 'a', "test-b": 'b'} {
+		key := bytes.Repeat([]byte{b}, EncryptionKeySize)
+		if err := AddKeyProvider(name, func() ([]byte, error) { return key, nil }); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func encryptedSpec(provider string, encryptKeys bool, c string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "encrypted",
+		"keyProvider": provider,
+		"cipher":      c,
+		"encryptKeys": encryptKeys,
+		"child": map[string]interface{}{
+			"type":      "afero",
+			"path":      "blocks",
+			"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+		},
+	}
+}
+
+// requireNoPlaintext fails if any file of fs contains one of the secrets.
+func requireNoPlaintext(t *testing.T, fs afero.Fs, secrets ...string) {
+	require.NoError(t, afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		for _, s := range secrets {
+			require.NotContains(t, path, s)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		buf, err := afero.ReadFile(fs, path)
+		require.NoError(t, err)
+		for _, s := range secrets {
+			require.NotContains(t, string(buf), s, path)
+		}
+		return nil
+	}))
+}
+
+func TestEncryptedDatastore(t *testing.T) {
+	for _, c := range []string{CipherXChaCha20Poly1305, CipherAES256GCM} {
+		for _, encryptKeys := range []bool{false, true} {
+			dsc, err := AnyDatastoreConfig(encryptedSpec("test-a", encryptKeys, c))
+			require.NoError(t, err)
+
+			fs := afero.NewMemMapFs()
+			d, err := dsc.Create(fs, "/repo")
+			require.NoError(t, err)
+
+			key := ds.NewKey("/secretkey")
+			require.NoError(t, d.Put(key, []byte("secretvalue")))
+
+			value, err := d.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte("secretvalue"), value)
+			size, err := d.GetSize(key)
+			require.NoError(t, err)
+			require.Equal(t, len("secretvalue"), size)
+
+			b, err := d.Batch()
+			require.NoError(t, err)
+			require.NoError(t, b.Put(ds.NewKey("/secretbatch"), []byte("secretbatchvalue")))
+			require.NoError(t, b.Commit())
+
+			txn, err := d.(ds.TxnDatastore).NewTransaction(false)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(ds.NewKey("/secrettxn"), []byte("secrettxnvalue")))
+			value, err = txn.Get(ds.NewKey("/secretbatch"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("secretbatchvalue"), value)
+			require.NoError(t, txn.Commit())
+
+			res, err := d.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			require.Len(t, entries, 3)
+			require.Equal(t, "/secretbatch", entries[0].Key)
+			require.Equal(t, []byte("secretbatchvalue"), entries[0].Value)
+			require.Equal(t, "/secretkey", entries[1].Key)
+			require.Equal(t, "/secrettxn", entries[2].Key)
+
+			secrets := []string{"secretvalue", "secretbatchvalue", "secrettxnvalue"}
+			if encryptKeys {
+				secrets = append(secrets, "secretkey", "secretbatch", "secrettxn")
+			}
+			requireNoPlaintext(t, fs, secrets...)
+
+			// a value can't be moved under another key
+			raw, err := dsc.(*encryptedDatastoreConfig).child.Create(fs, "/repo")
+			require.NoError(t, err)
+			s := d.(*encryptedTxnDatastore).s
+			sealed, err := raw.Get(s.storeKey(key))
+			require.NoError(t, err)
+			require.NoError(t, raw.Put(s.storeKey(ds.NewKey("/other")), sealed))
+			_, err = d.Get(ds.NewKey("/other"))
+			require.ErrorIs(t, err, ErrDecrypt)
+		}
+	}
+}
+
+func TestEncryptedDatastoreWrongKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "encrypted", t)
+
+	spec := encryptedSpec("test-a", true, CipherXChaCha20Poly1305)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: config.Datastore{Spec: spec}}))
+
+	specBytes, err := afero.ReadFile(fs, path+"/"+specFn)
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(specBytes), "fingerprint"))
+	require.False(t, strings.Contains(string(specBytes), "test-a"), "key provider is a runtime value")
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ds.NewKey("/foo"), []byte("bar")))
+	require.NoError(t, r.Close())
+
+	// swap the key used by the config
+	configFilename, err := config.Filename(path)
+	require.NoError(t, err)
+	var mapconf map[string]interface{}
+	require.NoError(t, ReadConfigFile(fs, configFilename, &mapconf))
+	spec["keyProvider"] = "test-b"
+	mapconf["Datastore"].(map[string]interface{})["Spec"] = spec
+	require.NoError(t, WriteConfigFile(fs, configFilename, mapconf))
+
+	_, err = Open(fs, path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match what is on disk")
+}
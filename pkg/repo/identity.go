@@ -0,0 +1,210 @@
+package repo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	config "github.com/ipfs/go-ipfs-config"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/ipfs/go-ipfs/repo/common"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
+)
+
+// IdentityKeyName is the reserved keystore name of the identity key of a repo
+// converted by MoveIdentityToKeystore. It is hidden from List and can't be
+// deleted.
+const IdentityKeyName = "_identity"
+
+var ErrReservedKeyName = errors.New("key name is reserved")
+
+// MoveIdentityToKeystore moves the identity key out of the config of the repo
+// at path into its keystore, and removes it from the config backups. The
+// config then only holds the PeerID, and AferoRepo.Config re-hydrates the key
+// from the keystore. ks is the keystore of the repo, it must be given unlocked
+// when it is encrypted, if nil the plaintext keystore is used. The repo must
+// not be opened. It can be run again to resume an interrupted conversion. The
+// identity of a converted repo can't be changed with SetConfig.
+func MoveIdentityToKeystore(fs afero.Fs, path string, ks keystore.Keystore) error {
+	path, err := homedir.Expand(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	lk, err := lockfile.ExclusiveLocker.Lock(fs, path, repoLock)
+	if err != nil {
+		return errors.Wrap(err, "lock repo")
+	}
+	defer lk.Close()
+
+	if ks == nil {
+		ks, err = NewAferoKeystore(fs, filepath.Join(path, "keystore"))
+		if err != nil {
+			return errors.Wrap(err, "open keystore")
+		}
+	}
+
+	configFilename, err := config.Filename(path)
+	if err != nil {
+		return err
+	}
+	var mapconf map[string]interface{}
+	if err := ReadConfigFile(fs, configFilename, &mapconf); err != nil {
+		return err
+	}
+	conf, err := config.FromMap(mapconf)
+	if err != nil {
+		return err
+	}
+
+	// the key is only removed from the config once safely in the keystore
+	if conf.Identity.PrivKey != "" {
+		sk, err := conf.Identity.DecodePrivateKey("")
+		if err != nil {
+			return errors.Wrap(err, "decode identity key")
+		}
+		if err := putIdentityKey(ks, sk); err != nil {
+			return err
+		}
+		if _, err := identityKey(ks, conf.Identity.PeerID); err != nil {
+			return err
+		}
+
+		scrubPrivKey(mapconf)
+		if err := WriteConfigFile(fs, configFilename, mapconf); err != nil {
+			return errors.Wrap(err, "write config")
+		}
+	}
+
+	return scrubConfigBackups(fs, path)
+}
+
+// putIdentityKey stores sk in ks, succeeding if it is already there.
+func putIdentityKey(ks keystore.Keystore, sk ci.PrivKey) error {
+	has, err := ks.Has(IdentityKeyName)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ks.Put(IdentityKeyName, sk)
+	}
+
+	existing, err := ks.Get(IdentityKeyName)
+	if err != nil {
+		return err
+	}
+	if !existing.Equals(sk) {
+		return errors.New("keystore already holds another identity key")
+	}
+	return nil
+}
+
+// identityKey gets the identity key from ks, checking it matches peerID.
+func identityKey(ks keystore.Keystore, peerID string) (ci.PrivKey, error) {
+	sk, err := ks.Get(IdentityKeyName)
+	if err != nil {
+		return nil, errors.Wrap(err, "get identity key")
+	}
+
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	if id.Pretty() != peerID {
+		return nil, errors.Errorf("identity key of %s doesn't match the config PeerID %s", id.Pretty(), peerID)
+	}
+	return sk, nil
+}
+
+// scrubPrivKey removes the identity key from a config map.
+func scrubPrivKey(mapconf map[string]interface{}) {
+	if identity, ok := mapconf[config.IdentityTag].(map[string]interface{}); ok {
+		delete(identity, config.PrivKeyTag)
+	}
+}
+
+// scrubConfigBackups removes the identity key from the config backups, and
+// removes the temp files of interrupted config writes.
+func scrubConfigBackups(fs afero.Fs, path string) error {
+	infos, err := afero.ReadDir(fs, path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		fn := filepath.Join(path, name)
+		switch {
+		case info.IsDir():
+		case isTempFileOf(name, config.DefaultConfigFile):
+			if err := fs.Remove(fn); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, config.DefaultConfigFile+"-"):
+			if err := scrubConfigBackup(fs, fn, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "scrub %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func scrubConfigBackup(fs afero.Fs, fn string, mode os.FileMode) error {
+	buf, err := afero.ReadFile(fs, fn)
+	if err != nil {
+		return err
+	}
+
+	var mapconf map[string]interface{}
+	if err := json.Unmarshal(buf, &mapconf); err != nil {
+		log.Warnf("not scrubbing config backup %s: %v", fn, err)
+		return nil
+	}
+	if _, err := common.MapGetKV(mapconf, config.PrivKeySelector); err != nil {
+		// nothing to scrub
+		return nil
+	}
+	scrubPrivKey(mapconf)
+
+	f, err := atomicfile.New(fs, fn, mode)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, mapconf); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// loadIdentityUnsynced re-hydrates the identity key of the config from the
+// keystore. Caller must hold the packageLock.
+func (r *AferoRepo) loadIdentityUnsynced() error {
+	if !r.identityInKeystore || r.config.Identity.PrivKey != "" {
+		return nil
+	}
+
+	sk, err := identityKey(r.keystore, r.config.Identity.PeerID)
+	if err != nil {
+		return err
+	}
+	b, err := ci.MarshalPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	// the config returned by Config is shared, it must not be modified
+	cfg := *r.config
+	cfg.Identity.PrivKey = base64.StdEncoding.EncodeToString(b)
+	r.config = &cfg
+	return nil
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/go-ipfs-config"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func testIdentity(t *testing.T) config.Identity {
+	sk, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	b, err := ci.MarshalPrivateKey(sk)
+	require.NoError(t, err)
+	return config.Identity{PeerID: id.Pretty(), PrivKey: base64.StdEncoding.EncodeToString(b)}
+}
+
+func TestMoveIdentityToKeystore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "identity", t)
+	identity := testIdentity(t)
+	require.NoError(t, Init(fs, path, &config.Config{Identity: identity, Datastore: DefaultDatastoreConfig()}))
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	_, err = r.BackupConfig("pre-identity-")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	// a leftover of an interrupted config write
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(path, "config123"), []byte(identity.PrivKey), 0600))
+
+	require.NoError(t, MoveIdentityToKeystore(fs, path, nil))
+	// converting again is a no-op
+	require.NoError(t, MoveIdentityToKeystore(fs, path, nil))
+
+	requireNoPlaintext(t, fs, identity.PrivKey)
+	backups, err := afero.Glob(fs, filepath.Join(path, "config-pre-identity-*"))
+	require.NoError(t, err)
+	require.Len(t, backups, 1, "backups are scrubbed, not removed")
+
+	r, err = Open(fs, path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	conf, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity, conf.Identity)
+
+	names, err := r.Keystore().List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.ErrorIs(t, r.Keystore().Delete(IdentityKeyName), ErrReservedKeyName)
+
+	// updates don't write the key back to the config
+	require.NoError(t, r.SetConfigKey(config.PrivKeySelector, "overwritten"))
+	require.NoError(t, r.SetConfigKey("Addresses.API", []string{"/ip4/127.0.0.1/tcp/5001"}))
+	conf, err = r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity, conf.Identity)
+
+	updated := *conf
+	updated.Identity.PrivKey = ""
+	require.NoError(t, r.SetConfig(&updated))
+	conf, err = r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity, conf.Identity)
+
+	requireNoPlaintext(t, fs, identity.PrivKey, "overwritten")
+}
+
+func TestMoveIdentityToKeystoreMismatch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "identity", t)
+	require.NoError(t, Init(fs, path, &config.Config{Identity: testIdentity(t), Datastore: DefaultDatastoreConfig()}))
+
+	// the keystore already holds another identity
+	other, err := base64.StdEncoding.DecodeString(testIdentity(t).PrivKey)
+	require.NoError(t, err)
+	sk, err := ci.UnmarshalPrivateKey(other)
+	require.NoError(t, err)
+	ks, err := NewAferoKeystore(fs, filepath.Join(path, "keystore"))
+	require.NoError(t, err)
+	require.NoError(t, ks.Put(IdentityKeyName, sk))
+
+	require.Error(t, MoveIdentityToKeystore(fs, path, ks))
+
+	conf, err := Load(fs, filepath.Join(path, config.DefaultConfigFile))
+	require.NoError(t, err)
+	require.NotEmpty(t, conf.Identity.PrivKey, "the config must keep the key on failure")
+}
+
+func TestRotateIdentityInKeystore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "identity", t)
+	identity := testIdentity(t)
+	require.NoError(t, Init(fs, path, &config.Config{Identity: identity, Datastore: DefaultDatastoreConfig()}))
+	require.NoError(t, MoveIdentityToKeystore(fs, path, nil))
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	changes := r.(ConfigSubscriber).Subscribe(context.Background())
+	require.NoError(t, r.SetConfigKey("Addresses.API", []string{"/ip4/127.0.0.1/tcp/5001"}))
+	c := receiveConfigChange(t, changes)
+
+	// loading the key doesn't modify the configs already shared
+	conf, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity, conf.Identity)
+	require.Empty(t, c.New.Identity.PrivKey)
+
+	// the keystore only holds the key of the current identity
+	updated := *conf
+	updated.Identity = testIdentity(t)
+	require.ErrorIs(t, r.SetConfig(&updated), ErrConfigIdentityChanged)
+	require.ErrorIs(t, r.SetConfigKey("Identity.PeerID", updated.Identity.PeerID), ErrConfigIdentityChanged)
+	require.NoError(t, r.Close())
+
+	r, err = Open(fs, path)
+	require.NoError(t, err)
+	defer r.Close()
+	conf, err = r.Config()
+	require.NoError(t, err)
+	require.Equal(t, identity, conf.Identity)
+}
@@ -1,13 +1,21 @@
 package repo
 
 import (
+	"fmt"
+	"path/filepath"
+
 	config "github.com/ipfs/go-ipfs-config"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
 )
 
 const specFn = "datastore_spec"
 
 // Init initializes a new FSRepo at the given path with the provided config.
+// The config, datastore spec and version files are committed together, so a
+// crash can't leave a half-initialized repo.
 // TODO add support for custom datastores.
 func Init(fs afero.Fs, repoPath string, conf *config.Config) error {
 	// packageLock must be held to ensure that the repo is not initialized more
@@ -15,49 +23,58 @@ func Init(fs afero.Fs, repoPath string, conf *config.Config) error {
 	packageLock.Lock()
 	defer packageLock.Unlock()
 
+	configFilename, err := config.Filename(repoPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(configFilename)
+	// complete an initialization interrupted by a crash
+	if err := atomicfile.Recover(fs, dir); err != nil {
+		return errors.Wrap(err, "recover interrupted init")
+	}
+
 	if isInitializedUnsynced(fs, repoPath) {
 		return nil
 	}
 
-	if err := initConfig(fs, repoPath, conf); err != nil {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	g := atomicfile.NewGroup(fs, dir)
+
+	if err := initConfig(fs, g, configFilename, conf); err != nil {
+		g.Abort()
 		return err
 	}
 
-	if err := initSpec(fs, repoPath, conf.Datastore.Spec); err != nil {
+	if err := initSpec(fs, g, filepath.Join(dir, specFn), conf.Datastore.Spec); err != nil {
+		g.Abort()
 		return err
 	}
 
-	if err := WriteRepoVersion(fs, repoPath, RepoVersion); err != nil {
+	if err := g.WriteFile(versionFile, []byte(fmt.Sprintf("%d\n", RepoVersion)), 0644); err != nil {
+		g.Abort()
 		return err
 	}
 
-	return nil
+	return g.Commit()
 }
 
-func initConfig(fs afero.Fs, path string, conf *config.Config) error {
-	if configIsInitialized(fs, path) {
+func initConfig(fs afero.Fs, g *atomicfile.Group, fn string, conf *config.Config) error {
+	if FileExists(fs, fn) {
 		return nil
 	}
-	configFilename, err := config.Filename(path)
-	if err != nil {
-		return err
-	}
 	// initialization is the one time when it's okay to write to the config
 	// without reading the config from disk and merging any user-provided keys
 	// that may exist.
-	if err := WriteConfigFile(fs, configFilename, conf); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func initSpec(fs afero.Fs, path string, conf map[string]interface{}) error {
-	fn, err := config.Path(path, specFn)
+	buf, err := config.Marshal(conf)
 	if err != nil {
 		return err
 	}
+	return g.WriteFile(filepath.Base(fn), buf, 0600)
+}
 
+func initSpec(fs afero.Fs, g *atomicfile.Group, fn string, conf map[string]interface{}) error {
 	if FileExists(fs, fn) {
 		return nil
 	}
@@ -68,5 +85,5 @@ func initSpec(fs afero.Fs, path string, conf map[string]interface{}) error {
 	}
 	bytes := dsc.DiskSpec().Bytes()
 
-	return afero.WriteFile(fs, fn, bytes, 0600)
+	return g.WriteFile(filepath.Base(fn), bytes, 0600)
 }
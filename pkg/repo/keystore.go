@@ -1,6 +1,7 @@
 package repo
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,17 +12,34 @@ import (
 	"github.com/apex/log"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
 )
 
 var codec = base32.StdEncoding.WithPadding(base32.NoPadding)
 
 const keyFilenamePrefix = "key_"
 
+// keyTempFilePrefix starts the names of the temporary files of the keys being
+// written, see atomicfile.NewExclusive.
+const keyTempFilePrefix = "." + keyFilenamePrefix
+
+// ErrCorruptKey is returned for a key file that can't be decoded, like the
+// empty or short files left by an interrupted write before keys were written
+// atomically. Such files are reported by Check and can be replaced by Put.
+var ErrCorruptKey = errors.New("key file is corrupt or partially written")
+
 // AferoKeystore is a keystore backed by files in a given directory stored on disk.
 type AferoKeystore struct {
 	dir string
 	fs  afero.Fs
+
+	secureDelete bool
+	// encrypted is set for the keystore of an EncryptedAferoKeystore, the
+	// fingerprints of its keys are then never stored in plaintext
+	encrypted bool
 }
 
 // NewAferoKeystore returns a new filesystem-backed keystore.
@@ -33,7 +51,7 @@ func NewAferoKeystore(fs afero.Fs, dir string) (*AferoKeystore, error) {
 	default:
 		return nil, err
 	}
-	return &AferoKeystore{dir, fs}, nil
+	return &AferoKeystore{dir: dir, fs: fs}, nil
 }
 
 // Has returns whether or not a key exists in the Keystore
@@ -45,17 +63,20 @@ func (ks *AferoKeystore) Has(name string) (bool, error) {
 
 	kp := filepath.Join(ks.dir, name)
 
-	_, err = ks.fs.Stat(kp)
+	st, err := ks.fs.Stat(kp)
 
 	if os.IsNotExist(err) {
 		return false, nil
 	}
-	return err == nil, err
+	if err != nil {
+		return false, err
+	}
+	return !isHalfWrittenKey(st), nil
 }
 
 // Put stores a key in the Keystore, if a key with the same name already exists, returns ErrKeyExists
 func (ks *AferoKeystore) Put(name string, k ci.PrivKey) error {
-	name, err := keystoreEncode(name)
+	fn, err := keystoreEncode(name)
 	if err != nil {
 		return err
 	}
@@ -65,20 +86,82 @@ func (ks *AferoKeystore) Put(name string, k ci.PrivKey) error {
 		return err
 	}
 
-	kp := filepath.Join(ks.dir, name)
+	err = ks.writeKey(fn, b, func(data []byte) error {
+		written, err := ci.UnmarshalPrivateKey(data)
+		if err != nil {
+			return err
+		}
+		if !written.Equals(k) {
+			return errors.New("decoded key differs")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	info := newKeyInfo(k)
+	if err := ks.writeInfo(fn, info); err != nil {
+		return err
+	}
+	ks.audit(AuditPut, name, "", info.ID)
+	return nil
+}
+
+// writeKey creates the key file fn holding data through a temporary file, so
+// the key is either fully written or missing. It returns ErrKeyExists if the
+// key already exists. The written data are read back and validated by check
+// before the key file is published.
+func (ks *AferoKeystore) writeKey(fn string, data []byte, check func([]byte) error) error {
+	kp := filepath.Join(ks.dir, fn)
+
+	// a half-written key doesn't block re-creating the key
+	st, err := ks.fs.Stat(kp)
+	if err == nil && isHalfWrittenKey(st) {
+		log.Warnf("Replacing half-written keyfile: %s", fn)
+		if err := ks.fs.Remove(kp); err != nil {
+			return err
+		}
+	}
 
-	fi, err := ks.fs.OpenFile(kp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	f, err := atomicfile.NewExclusive(ks.fs, kp, 0400)
 	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Abort()
+		return err
+	}
+
+	written, err := afero.ReadFile(ks.fs, f.Name())
+	if err == nil && !bytes.Equal(written, data) {
+		err = errors.New("read back data differ")
+	}
+	if err == nil {
+		err = check(written)
+	}
+	if err != nil {
+		f.Abort()
+		return errors.Wrap(err, "validate key file")
+	}
+
+	if err := f.Close(); err != nil {
 		if os.IsExist(err) {
-			err = keystore.ErrKeyExists
+			return keystore.ErrKeyExists
 		}
 		return err
 	}
-	defer fi.Close()
-
-	_, err = fi.Write(b)
+	return nil
+}
 
-	return err
+// isHalfWrittenKey returns whether a key file was left empty by an
+// interrupted write.
+func isHalfWrittenKey(st os.FileInfo) bool {
+	return st.Size() == 0
 }
 
 // Get retrieves a key from the Keystore if it exists, and returns ErrNoSuchKey
@@ -99,19 +182,88 @@ func (ks *AferoKeystore) Get(name string) (ci.PrivKey, error) {
 		return nil, err
 	}
 
-	return ci.UnmarshalPrivateKey(data)
+	k, err := ci.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptKey, "keyfile %s: %v", name, err)
+	}
+	return k, nil
 }
 
 // Delete removes a key from the Keystore
 func (ks *AferoKeystore) Delete(name string) error {
-	name, err := keystoreEncode(name)
+	if name == IdentityKeyName {
+		return ErrReservedKeyName
+	}
+
+	fn, err := keystoreEncode(name)
 	if err != nil {
 		return err
 	}
 
-	kp := filepath.Join(ks.dir, name)
+	kp := filepath.Join(ks.dir, fn)
+
+	fingerprint := ks.storedFingerprint(fn)
+	if err := ks.removeKeyFile(kp); err != nil {
+		return err
+	}
+	ks.audit(AuditDelete, name, "", fingerprint)
 
-	return ks.fs.Remove(kp)
+	return ks.removeInfo(fn)
+}
+
+// Rename renames a key of the Keystore along with its metadata. The key file
+// is written under the new name, failing with ErrKeyExists if it is taken,
+// before the old one is removed, so the key is always found under one of its
+// names.
+func (ks *AferoKeystore) Rename(oldName, newName string) error {
+	if oldName == IdentityKeyName || newName == IdentityKeyName {
+		return ErrReservedKeyName
+	}
+
+	oldFn, newFn, err := ks.renameFilenames(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	oldKp := filepath.Join(ks.dir, oldFn)
+	data, err := afero.ReadFile(ks.fs, oldKp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keystore.ErrNoSuchKey
+		}
+		return err
+	}
+	err = ks.writeKey(newFn, data, func(written []byte) error {
+		_, err := ci.UnmarshalPrivateKey(written)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fingerprint := ks.storedFingerprint(oldFn)
+	if err := ks.renameInfo(oldFn, newFn); err != nil {
+		return err
+	}
+	if err := ks.removeKeyFile(oldKp); err != nil {
+		return err
+	}
+	ks.audit(AuditRename, oldName, newName, fingerprint)
+	return nil
+}
+
+// renameFilenames returns the filenames of a key renamed from oldName to
+// newName.
+func (ks *AferoKeystore) renameFilenames(oldName, newName string) (string, string, error) {
+	oldFn, err := keystoreEncode(oldName)
+	if err != nil {
+		return "", "", err
+	}
+	newFn, err := keystoreEncode(newName)
+	if err != nil {
+		return "", "", err
+	}
+	return oldFn, newFn, nil
 }
 
 // List return a list of key identifier
@@ -121,15 +273,26 @@ func (ks *AferoKeystore) List() ([]string, error) {
 		return nil, err
 	}
 
-	dirs, err := dir.Readdirnames(0)
+	dirs, err := dir.Readdir(0)
 	if err != nil {
 		return nil, err
 	}
 
 	list := make([]string, 0, len(dirs))
 
-	for _, name := range dirs {
+	for _, st := range dirs {
+		name := st.Name()
+		if name == keystoreHeaderFn || name == keystoreAuditFn || isKeyInfoFile(name) {
+			continue
+		}
+		if strings.HasPrefix(name, keyTempFilePrefix) || isHalfWrittenKey(st) {
+			log.Warnf("Ignoring half-written keyfile: %s", name)
+			continue
+		}
 		decodedName, err := decode(name)
+		if decodedName == IdentityKeyName {
+			continue
+		}
 		if err == nil {
 			list = append(list, decodedName)
 		} else {
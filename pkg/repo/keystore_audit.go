@@ -0,0 +1,272 @@
+package repo
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// keystoreAuditFn is the append-only log of the operations on the keys of a
+// keystore, one JSON encoded AuditEvent per line.
+const keystoreAuditFn = "AUDIT"
+
+// AuditOp is an operation recorded in the audit log of a keystore.
+type AuditOp string
+
+const (
+	AuditPut    AuditOp = "put"
+	AuditDelete AuditOp = "delete"
+	AuditRename AuditOp = "rename"
+	AuditExport AuditOp = "export"
+)
+
+// AuditEvent is an entry of the audit log of a keystore. It never holds key
+// material.
+type AuditEvent struct {
+	Time time.Time
+	Op   AuditOp
+	Name string
+	// NewName is the name of a renamed key.
+	NewName string `json:",omitempty"`
+	// Fingerprint is the peer ID of the key, it is empty when the key can't
+	// be read, like the keys stored before metadata were introduced, and in
+	// the audit log of an EncryptedAferoKeystore, as it identifies the key.
+	Fingerprint string `json:",omitempty"`
+}
+
+// AuditQuery selects events of the audit log, its zero value selects all the
+// events.
+type AuditQuery struct {
+	// Name selects the events on a key, under its old or new name.
+	Name string
+	Ops  []AuditOp
+	// Since and Until bound the time of the events, when not zero.
+	Since time.Time
+	Until time.Time
+}
+
+func (q AuditQuery) match(e AuditEvent) bool {
+	if q.Name != "" && q.Name != e.Name && q.Name != e.NewName {
+		return false
+	}
+	if len(q.Ops) != 0 {
+		found := false
+		for _, op := range q.Ops {
+			found = found || op == e.Op
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog returns the events of the audit log matching q, oldest first.
+func (ks *AferoKeystore) AuditLog(q AuditQuery) ([]AuditEvent, error) {
+	f, err := ks.fs.Open(filepath.Join(ks.dir, keystoreAuditFn))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line may have been cut by a crash
+			log.Warnf("Ignoring invalid audit log line %d: %v", line, err)
+			continue
+		}
+		if q.match(e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// audit appends an event to the audit log. The operation is already done, so
+// a failure is only logged.
+func (ks *AferoKeystore) audit(op AuditOp, name, newName, fingerprint string) {
+	if ks.encrypted {
+		fingerprint = ""
+	}
+	e := AuditEvent{Time: time.Now().UTC(), Op: op, Name: name, NewName: newName, Fingerprint: fingerprint}
+	if err := ks.appendAuditEvent(e); err != nil {
+		log.Errorf("Failed to audit %s of key %q: %v", op, name, err)
+	}
+}
+
+func (ks *AferoKeystore) appendAuditEvent(e AuditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := ks.fs.OpenFile(filepath.Join(ks.dir, keystoreAuditFn), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// a leading newline isolates the event from a line cut by a crash
+	if _, err := f.Write(append(append([]byte{'\n'}, buf...), '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// scrubFingerprints removes the fingerprints from the key metadata and the
+// audit log written before the keystore was encrypted.
+func (ks *AferoKeystore) scrubFingerprints() error {
+	names, err := ks.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fn, err := keystoreEncode(name)
+		if err != nil {
+			return err
+		}
+		info, err := ks.readInfo(fn)
+		if err != nil {
+			return err
+		}
+		if info.ID == "" {
+			continue
+		}
+		if err := ks.writeInfo(fn, info); err != nil {
+			return err
+		}
+	}
+
+	events, err := ks.AuditLog(AuditQuery{})
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	var buf []byte
+	for _, e := range events {
+		e.Fingerprint = ""
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	f, err := atomicfile.New(ks.fs, filepath.Join(ks.dir, keystoreAuditFn), 0600, atomicfile.SyncFile())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// auditExport records the export of a key, see ExportKey.
+func (ks *AferoKeystore) auditExport(name string, k ci.PrivKey) {
+	ks.audit(AuditExport, name, "", keyFingerprint(k))
+}
+
+// keyFingerprint returns the peer ID of k, or an empty string if it can't be
+// computed.
+func keyFingerprint(k ci.PrivKey) string {
+	id, err := peer.IDFromPrivateKey(k)
+	if err != nil {
+		return ""
+	}
+	return id.Pretty()
+}
+
+// storedFingerprint returns the fingerprint of the key in the file fn, from
+// its metadata or from the key itself if it is not encrypted.
+func (ks *AferoKeystore) storedFingerprint(fn string) string {
+	if info, err := ks.readInfo(fn); err == nil && info.ID != "" {
+		return info.ID
+	}
+
+	data, err := afero.ReadFile(ks.fs, filepath.Join(ks.dir, fn))
+	if err != nil {
+		return ""
+	}
+	k, err := ci.UnmarshalPrivateKey(data)
+	if err != nil {
+		return ""
+	}
+	return keyFingerprint(k)
+}
+
+// SetSecureDelete enables overwriting the key files with random data before
+// removing them, on filesystems backed by the OS. The keys of other
+// filesystems are only removed.
+func (ks *AferoKeystore) SetSecureDelete(enabled bool) {
+	ks.secureDelete = enabled
+}
+
+// removeKeyFile removes the key file kp, overwriting it first when secure
+// delete is enabled.
+func (ks *AferoKeystore) removeKeyFile(kp string) error {
+	if _, ok := ks.fs.(*afero.OsFs); ok && ks.secureDelete {
+		if err := overwriteFile(ks.fs, kp); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "overwrite key file")
+		}
+	}
+	return ks.fs.Remove(kp)
+}
+
+// overwriteFile overwrites the content of the file fn with random data.
+func overwriteFile(fs afero.Fs, fn string) error {
+	st, err := fs.Stat(fn)
+	if err != nil {
+		return err
+	}
+	// key files are read-only
+	if err := fs.Chmod(fn, 0600); err != nil {
+		return err
+	}
+
+	f, err := fs.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	noise := make([]byte, st.Size())
+	if _, err := rand.Read(noise); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(noise, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,100 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAferoKeystoreAuditLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	ks, err := NewAferoKeystore(fs, "/keystore")
+	require.NoError(t, err)
+
+	start := time.Now().UTC()
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(k)
+	require.NoError(t, err)
+
+	require.NoError(t, ks.Put("self", k))
+	require.NoError(t, ks.Rename("self", "renamed"))
+	_, err = ExportKey(ks, "renamed", KeyFormatLibp2p, nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Delete("renamed"))
+	require.Error(t, ks.Delete("renamed"))
+
+	events, err := ks.AuditLog(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	for i, op := range []AuditOp{AuditPut, AuditRename, AuditExport, AuditDelete} {
+		require.Equal(t, op, events[i].Op)
+		require.Equal(t, id.Pretty(), events[i].Fingerprint)
+		require.False(t, events[i].Time.Before(start))
+	}
+	require.Equal(t, "self", events[1].Name)
+	require.Equal(t, "renamed", events[1].NewName)
+
+	events, err = ks.AuditLog(AuditQuery{Name: "self"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	events, err = ks.AuditLog(AuditQuery{Ops: []AuditOp{AuditDelete, AuditPut}})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	events, err = ks.AuditLog(AuditQuery{Since: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// never key material
+	buf, err := afero.ReadFile(fs, filepath.Join("/keystore", keystoreAuditFn))
+	require.NoError(t, err)
+	b, err := ci.MarshalPrivateKey(k)
+	require.NoError(t, err)
+	raw, err := k.Raw()
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf, b))
+	require.False(t, bytes.Contains(buf, raw))
+
+	names, err := ks.List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestAferoKeystoreSecureDelete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ks, err := NewAferoKeystore(afero.NewOsFs(), filepath.Join(dir, "keystore"))
+	require.NoError(t, err)
+	ks.SetSecureDelete(true)
+
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("self", k))
+
+	// a second link keeps the content of the key file readable
+	fn, err := keystoreEncode("self")
+	require.NoError(t, err)
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Link(filepath.Join(dir, "keystore", fn), link))
+
+	require.NoError(t, ks.Delete("self"))
+	has, err := ks.Has("self")
+	require.NoError(t, err)
+	require.False(t, has)
+
+	b, err := ci.MarshalPrivateKey(k)
+	require.NoError(t, err)
+	buf, err := os.ReadFile(link)
+	require.NoError(t, err)
+	require.Len(t, buf, len(b))
+	require.NotEqual(t, b, buf, "the key file was not overwritten")
+}
@@ -0,0 +1,535 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// The keys of an encrypted keystore are sealed with a random keystore key,
+// itself sealed with a key derived from the passphrase and stored in the
+// header file. Changing the passphrase only rewrites the header.
+const (
+	keystoreHeaderFn      = "HEADER"
+	keystoreHeaderVersion = 1
+
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
+)
+
+// encryptedKeyMagic prefixes the encrypted key files, telling them apart from
+// the plaintext ones while a keystore is converted.
+var encryptedKeyMagic = []byte("aferoks1")
+
+var (
+	ErrKeystoreLocked  = errors.New("keystore is locked")
+	ErrWrongPassphrase = errors.New("wrong keystore passphrase")
+	ErrKeyNotEncrypted = errors.New("key is not encrypted")
+)
+
+// KDFParams are the parameters deriving the key of a keystore from its
+// passphrase.
+type KDFParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+
+	// scrypt
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+
+	// argon2id
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+// DefaultKDFParams returns the scrypt parameters recommended for interactive
+// logins.
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Name: KDFScrypt, N: 1 << 15, R: 8, P: 1}
+}
+
+func (p KDFParams) derive(passphrase []byte) ([]byte, error) {
+	switch p.Name {
+	case KDFScrypt:
+		return scrypt.Key(passphrase, p.Salt, p.N, p.R, p.P, EncryptionKeySize)
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, EncryptionKeySize), nil
+	}
+	return nil, fmt.Errorf("unknown kdf: %q", p.Name)
+}
+
+type keystoreHeader struct {
+	Version int       `json:"version"`
+	KDF     KDFParams `json:"kdf"`
+	Cipher  string    `json:"cipher"`
+	// Key is the keystore key sealed with the passphrase key.
+	Key []byte `json:"key"`
+}
+
+// sealKeystoreKey returns a header holding key sealed with passphrase.
+func sealKeystoreKey(key, passphrase []byte, kdf KDFParams) (*keystoreHeader, error) {
+	kdf.Salt = make([]byte, 16)
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return nil, err
+	}
+
+	pkey, err := kdf.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(CipherXChaCha20Poly1305, pkey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &keystoreHeader{
+		Version: keystoreHeaderVersion,
+		KDF:     kdf,
+		Cipher:  CipherXChaCha20Poly1305,
+		Key:     aead.Seal(nonce, nonce, key, nil),
+	}, nil
+}
+
+// keystoreKey unseals the keystore key, failing if the passphrase is wrong.
+func (h *keystoreHeader) keystoreKey(passphrase []byte) ([]byte, error) {
+	pkey, err := h.KDF.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(h.Cipher, pkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Key) < aead.NonceSize() {
+		return nil, errors.New("invalid keystore header")
+	}
+	key, err := aead.Open(nil, h.Key[:aead.NonceSize()], h.Key[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func readKeystoreHeader(fs afero.Fs, dir string) (*keystoreHeader, error) {
+	buf, err := afero.ReadFile(fs, filepath.Join(dir, keystoreHeaderFn))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var h keystoreHeader
+	if err := json.Unmarshal(buf, &h); err != nil {
+		return nil, errors.Wrap(err, "decode keystore header")
+	}
+	if h.Version != keystoreHeaderVersion {
+		return nil, fmt.Errorf("unsupported keystore header version %d", h.Version)
+	}
+	return &h, nil
+}
+
+func writeKeystoreHeader(fs afero.Fs, dir string, h *keystoreHeader) error {
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	f, err := atomicfile.New(fs, filepath.Join(dir, keystoreHeaderFn), 0600, atomicfile.SyncFile(), atomicfile.SyncDir())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// EncryptedAferoKeystore is an AferoKeystore whose keys are encrypted with a
+// passphrase. The names of the keys are not encrypted, so Has, List and
+// Delete work while the keystore is locked.
+type EncryptedAferoKeystore struct {
+	*AferoKeystore
+	kdf KDFParams
+
+	mu     sync.RWMutex
+	header *keystoreHeader
+	key    []byte
+	aead   cipher.AEAD
+}
+
+var _ keystore.Keystore = (*EncryptedAferoKeystore)(nil)
+
+// NewEncryptedAferoKeystore returns a locked encrypted keystore. If the
+// keystore doesn't exist yet, it is created on the first Unlock with the
+// parameters of kdf, or DefaultKDFParams if kdf is nil.
+func NewEncryptedAferoKeystore(fs afero.Fs, dir string, kdf *KDFParams) (*EncryptedAferoKeystore, error) {
+	ks, err := NewAferoKeystore(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedKeystore(ks, kdf)
+}
+
+// newEncryptedKeystore wraps the existing keystore ks, reading its header if
+// it has one.
+func newEncryptedKeystore(ks *AferoKeystore, kdf *KDFParams) (*EncryptedAferoKeystore, error) {
+	header, err := readKeystoreHeader(ks.fs, ks.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks.encrypted = true
+	eks := &EncryptedAferoKeystore{AferoKeystore: ks, header: header, kdf: DefaultKDFParams()}
+	if kdf != nil {
+		eks.kdf = *kdf
+	}
+	return eks, nil
+}
+
+// isEncryptedKeystore returns whether the keystore in dir has a header.
+func isEncryptedKeystore(fs afero.Fs, dir string) bool {
+	return FileExists(fs, filepath.Join(dir, keystoreHeaderFn))
+}
+
+// Unlock unseals the keystore key with passphrase, failing with
+// ErrWrongPassphrase if it is not the one the keystore was created with.
+func (ks *EncryptedAferoKeystore) Unlock(passphrase []byte) error {
+	return ks.unlock(passphrase, false)
+}
+
+func (ks *EncryptedAferoKeystore) unlock(passphrase []byte, convert bool) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.header != nil {
+		key, err := ks.header.keystoreKey(passphrase)
+		if err != nil {
+			return err
+		}
+		return ks.setKey(key)
+	}
+
+	if !convert {
+		names, err := ks.AferoKeystore.List()
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return errors.Wrap(ErrKeyNotEncrypted, "plaintext keystore must be converted with EncryptAferoKeystore")
+		}
+	}
+
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	header, err := sealKeystoreKey(key, passphrase, ks.kdf)
+	if err != nil {
+		return err
+	}
+	if err := writeKeystoreHeader(ks.fs, ks.dir, header); err != nil {
+		return errors.Wrap(err, "write keystore header")
+	}
+	ks.header = header
+	return ks.setKey(key)
+}
+
+func (ks *EncryptedAferoKeystore) setKey(key []byte) error {
+	aead, err := newAEAD(ks.header.Cipher, key)
+	if err != nil {
+		return err
+	}
+	ks.key, ks.aead = key, aead
+	return nil
+}
+
+// Lock forgets the keystore key until the next Unlock.
+func (ks *EncryptedAferoKeystore) Lock() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i := range ks.key {
+		ks.key[i] = 0
+	}
+	ks.key, ks.aead = nil, nil
+}
+
+// Locked returns whether the keystore must be unlocked to access the keys.
+func (ks *EncryptedAferoKeystore) Locked() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.aead == nil
+}
+
+// ChangePassphrase seals the keystore key with a new passphrase. The keys
+// themselves are not rewritten.
+func (ks *EncryptedAferoKeystore) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.header == nil {
+		return errors.New("keystore was never unlocked")
+	}
+
+	key, err := ks.header.keystoreKey(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	header, err := sealKeystoreKey(key, newPassphrase, ks.header.KDF)
+	if err != nil {
+		return err
+	}
+	if err := writeKeystoreHeader(ks.fs, ks.dir, header); err != nil {
+		return errors.Wrap(err, "write keystore header")
+	}
+	ks.header = header
+	return nil
+}
+
+// Put stores an encrypted key in the Keystore, if a key with the same name
+// already exists, returns ErrKeyExists
+func (ks *EncryptedAferoKeystore) Put(name string, k ci.PrivKey) error {
+	fn, err := keystoreEncode(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := ci.MarshalPrivateKey(k)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := ks.seal(fn, b)
+	if err != nil {
+		return err
+	}
+
+	if err := ks.writeKey(fn, sealed, ks.checkSealed(fn, b)); err != nil {
+		return err
+	}
+
+	info := newKeyInfo(k)
+	if err := ks.writeInfo(fn, info); err != nil {
+		return err
+	}
+	ks.audit(AuditPut, name, "", info.ID)
+	return nil
+}
+
+// Rename renames a key of the Keystore along with its metadata. As keys are
+// bound to their file name, the key is encrypted again under its new name,
+// which requires the keystore to be unlocked. The new key file is written
+// before the old one is removed, so the key is never lost.
+func (ks *EncryptedAferoKeystore) Rename(oldName, newName string) error {
+	if oldName == IdentityKeyName || newName == IdentityKeyName {
+		return ErrReservedKeyName
+	}
+
+	oldFn, newFn, err := ks.renameFilenames(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	oldKp := filepath.Join(ks.dir, oldFn)
+	data, err := afero.ReadFile(ks.fs, oldKp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keystore.ErrNoSuchKey
+		}
+		return err
+	}
+	b, err := ks.open(oldFn, data)
+	if err != nil {
+		return errors.Wrapf(err, "key %q", oldName)
+	}
+	sealed, err := ks.seal(newFn, b)
+	if err != nil {
+		return err
+	}
+
+	if err := ks.writeKey(newFn, sealed, ks.checkSealed(newFn, b)); err != nil {
+		return err
+	}
+
+	if err := ks.renameInfo(oldFn, newFn); err != nil {
+		return err
+	}
+	if err := ks.removeKeyFile(oldKp); err != nil {
+		return err
+	}
+	if k, err := ci.UnmarshalPrivateKey(b); err == nil {
+		ks.audit(AuditRename, oldName, newName, keyFingerprint(k))
+	} else {
+		ks.audit(AuditRename, oldName, newName, "")
+	}
+	return nil
+}
+
+// Get retrieves and decrypts a key from the Keystore if it exists, and
+// returns ErrNoSuchKey otherwise.
+func (ks *EncryptedAferoKeystore) Get(name string) (ci.PrivKey, error) {
+	fn, err := keystoreEncode(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := afero.ReadFile(ks.fs, filepath.Join(ks.dir, fn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, keystore.ErrNoSuchKey
+		}
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, errors.Wrapf(ErrCorruptKey, "key %q", name)
+	}
+	b, err := ks.open(fn, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %q", name)
+	}
+	return ci.UnmarshalPrivateKey(b)
+}
+
+// checkSealed returns a check of writeKey verifying the key file fn decrypts
+// to b.
+func (ks *EncryptedAferoKeystore) checkSealed(fn string, b []byte) func([]byte) error {
+	return func(sealed []byte) error {
+		opened, err := ks.open(fn, sealed)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(opened, b) {
+			return errors.New("decrypted key differs")
+		}
+		return nil
+	}
+}
+
+// seal encrypts the key stored in the file fn, binding it to the file name so
+// keys can't be swapped.
+func (ks *EncryptedAferoKeystore) seal(fn string, b []byte) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.aead == nil {
+		return nil, ErrKeystoreLocked
+	}
+
+	sealed := make([]byte, len(encryptedKeyMagic)+ks.aead.NonceSize(), len(encryptedKeyMagic)+ks.aead.NonceSize()+len(b)+ks.aead.Overhead())
+	copy(sealed, encryptedKeyMagic)
+	nonce := sealed[len(encryptedKeyMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return ks.aead.Seal(sealed, nonce, b, []byte(fn)), nil
+}
+
+func (ks *EncryptedAferoKeystore) open(fn string, data []byte) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if !isEncryptedKey(data) {
+		return nil, ErrKeyNotEncrypted
+	}
+	if ks.aead == nil {
+		return nil, ErrKeystoreLocked
+	}
+
+	data = data[len(encryptedKeyMagic):]
+	if len(data) < ks.aead.NonceSize() {
+		return nil, errors.New("truncated key file")
+	}
+	b, err := ks.aead.Open(nil, data[:ks.aead.NonceSize()], data[ks.aead.NonceSize():], []byte(fn))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt key")
+	}
+	return b, nil
+}
+
+func isEncryptedKey(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedKeyMagic)
+}
+
+// EncryptAferoKeystore converts the plaintext keystore in dir to an encrypted
+// keystore in place. It can be run again with the same passphrase to resume
+// an interrupted conversion.
+func EncryptAferoKeystore(fs afero.Fs, dir string, passphrase []byte, kdf *KDFParams) (*EncryptedAferoKeystore, error) {
+	ks, err := NewEncryptedAferoKeystore(fs, dir, kdf)
+	if err != nil {
+		return nil, err
+	}
+	// the header is written first, so the keys encrypted before an
+	// interruption can be decrypted when resuming
+	if err := ks.unlock(passphrase, true); err != nil {
+		return nil, err
+	}
+
+	infos, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		fn := info.Name()
+		if info.IsDir() || !strings.HasPrefix(fn, keyFilenamePrefix) || isKeyInfoFile(fn) {
+			continue
+		}
+
+		kp := filepath.Join(dir, fn)
+		data, err := afero.ReadFile(fs, kp)
+		if err != nil {
+			return nil, err
+		}
+		if isEncryptedKey(data) {
+			continue
+		}
+		if _, err := ci.UnmarshalPrivateKey(data); err != nil {
+			return nil, errors.Wrapf(err, "decode plaintext key %s", fn)
+		}
+
+		sealed, err := ks.seal(fn, data)
+		if err != nil {
+			return nil, err
+		}
+		f, err := atomicfile.New(fs, kp, 0400)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(sealed); err != nil {
+			f.Abort()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, errors.Wrapf(err, "replace %s", fn)
+		}
+	}
+
+	if err := ks.scrubFingerprints(); err != nil {
+		return nil, errors.Wrap(err, "scrub fingerprints")
+	}
+	return ks, nil
+}
@@ -0,0 +1,204 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/go-ipfs-config"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// cheap parameters, the defaults are too slow for tests
+var testKDFParams = &KDFParams{Name: KDFScrypt, N: 1 << 10, R: 8, P: 1}
+
+func TestEncryptAferoKeystore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := "/repo/keystore"
+
+	plain, err := NewAferoKeystore(fs, dir)
+	require.NoError(t, err)
+	keys := make(map[string]ci.PrivKey)
+	for _, name := range []string{"self", "other"} {
+		k, _, err := ci.GenerateEd25519Key(nil)
+		require.NoError(t, err)
+		require.NoError(t, plain.Put(name, k))
+		keys[name] = k
+	}
+
+	// a plaintext keystore must be converted explicitly
+	ks, err := NewEncryptedAferoKeystore(fs, dir, testKDFParams)
+	require.NoError(t, err)
+	require.ErrorIs(t, ks.Unlock([]byte("pass")), ErrKeyNotEncrypted)
+	require.False(t, isEncryptedKeystore(fs, dir))
+
+	ks, err = EncryptAferoKeystore(fs, dir, []byte("pass"), testKDFParams)
+	require.NoError(t, err)
+	// converting again is a no-op
+	_, err = EncryptAferoKeystore(fs, dir, []byte("pass"), testKDFParams)
+	require.NoError(t, err)
+
+	for name, k := range keys {
+		fn, err := keystoreEncode(name)
+		require.NoError(t, err)
+		raw, err := afero.ReadFile(fs, filepath.Join(dir, fn))
+		require.NoError(t, err)
+		b, err := ci.MarshalPrivateKey(k)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(raw, b), "key %q was not encrypted", name)
+
+		got, err := ks.Get(name)
+		require.NoError(t, err)
+		require.True(t, k.Equals(got))
+	}
+
+	names, err := ks.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"self", "other"}, names)
+
+	// the plaintext keystore can't read the keys anymore
+	_, err = plain.Get("self")
+	require.Error(t, err)
+
+	ks.Lock()
+	require.True(t, ks.Locked())
+	_, err = ks.Get("self")
+	require.ErrorIs(t, err, ErrKeystoreLocked)
+	has, err := ks.Has("self")
+	require.NoError(t, err)
+	require.True(t, has)
+
+	ks, err = NewEncryptedAferoKeystore(fs, dir, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, ks.Unlock([]byte("wrong")), ErrWrongPassphrase)
+	require.NoError(t, ks.Unlock([]byte("pass")))
+
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("new", k))
+
+	require.ErrorIs(t, ks.ChangePassphrase([]byte("wrong"), []byte("new pass")), ErrWrongPassphrase)
+	require.NoError(t, ks.ChangePassphrase([]byte("pass"), []byte("new pass")))
+
+	ks, err = NewEncryptedAferoKeystore(fs, dir, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, ks.Unlock([]byte("pass")), ErrWrongPassphrase)
+	require.NoError(t, ks.Unlock([]byte("new pass")))
+	got, err := ks.Get("new")
+	require.NoError(t, err)
+	require.True(t, k.Equals(got))
+
+	// the keys can't be identified from the plaintext files, even those
+	// written before the conversion
+	require.NoError(t, ks.Rename("new", "renamed"))
+	_, err = ExportKey(ks, "renamed", KeyFormatLibp2p, nil)
+	require.NoError(t, err)
+	keys["new"] = k
+	require.NoError(t, afero.Walk(fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+		for name, k := range keys {
+			id, err := peer.IDFromPrivateKey(k)
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(buf, []byte(id.Pretty())), "%s holds the peer ID of %q", path, name)
+		}
+		return nil
+	}))
+	events, err := ks.AuditLog(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, events, 5)
+}
+
+func TestEncryptedAferoKeystoreArgon2(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	kdf := &KDFParams{Name: KDFArgon2id, Time: 1, Memory: 1024, Threads: 1}
+	ks, err := NewEncryptedAferoKeystore(fs, "/keystore", kdf)
+	require.NoError(t, err)
+
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, ks.Put("self", k), ErrKeystoreLocked)
+
+	require.NoError(t, ks.Unlock([]byte("pass")))
+	require.NoError(t, ks.Put("self", k))
+
+	header, err := readKeystoreHeader(fs, "/keystore")
+	require.NoError(t, err)
+	require.Equal(t, KDFArgon2id, header.KDF.Name)
+
+	ks, err = NewEncryptedAferoKeystore(fs, "/keystore", nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Unlock([]byte("pass")))
+	got, err := ks.Get("self")
+	require.NoError(t, err)
+	require.True(t, k.Equals(got))
+}
+
+func TestRepoEncryptedKeystore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "keystore", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	ks, err := NewEncryptedAferoKeystore(fs, filepath.Join(path, "keystore"), testKDFParams)
+	require.NoError(t, err)
+	require.NoError(t, ks.Unlock([]byte("pass")))
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("self", k))
+
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	eks, ok := r.Keystore().(*EncryptedAferoKeystore)
+	require.True(t, ok, "encrypted keystore was opened as %T", r.Keystore())
+	require.True(t, eks.Locked())
+	require.NoError(t, eks.Unlock([]byte("pass")))
+	got, err := eks.Get("self")
+	require.NoError(t, err)
+	require.True(t, k.Equals(got))
+}
+
+func TestRepoEncryptedKeystoreReadOnly(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "keystore-ro", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	ks, err := NewEncryptedAferoKeystore(fs, filepath.Join(path, "keystore"), testKDFParams)
+	require.NoError(t, err)
+	require.NoError(t, ks.Unlock([]byte("pass")))
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("self", k))
+
+	r, err := OpenReadOnly(fs, path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// the keys are never read as plaintext
+	rks, ok := r.Keystore().(readOnlyKeystore)
+	require.True(t, ok, "keystore was opened as %T", r.Keystore())
+	require.True(t, rks.Locked())
+	_, err = rks.Get("self")
+	require.Error(t, err)
+
+	require.NoError(t, rks.Unlock([]byte("pass")))
+	got, err := rks.Get("self")
+	require.NoError(t, err)
+	require.True(t, k.Equals(got))
+	require.ErrorIs(t, rks.Put("other", k), ErrReadOnly)
+}
@@ -0,0 +1,287 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Formats of exported keys, named after the formats of `ipfs key export`.
+const (
+	// KeyFormatLibp2p is the libp2p protobuf encoding of a key, as stored in
+	// a plaintext keystore.
+	KeyFormatLibp2p = "libp2p-protobuf-cleartext"
+	// KeyFormatPEMPKCS8 is a PEM encoded PKCS#8 key, encrypted with PBES2 when
+	// a passphrase is given. Secp256k1 keys are not supported.
+	KeyFormatPEMPKCS8 = "pem-pkcs8-cleartext"
+)
+
+var ErrUnsupportedKeyFormat = errors.New("unsupported key format")
+
+const (
+	pemPrivateKey          = "PRIVATE KEY"
+	pemEncryptedPrivateKey = "ENCRYPTED PRIVATE KEY"
+
+	// pbkdf2Iterations follows the OWASP recommendation for PBKDF2-SHA256.
+	pbkdf2Iterations = 600000
+	// maxPBKDF2Iterations bounds the work an imported key can ask for.
+	maxPBKDF2Iterations = 10 * pbkdf2Iterations
+)
+
+var (
+	oidPBES2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA256    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	errPKCS8Encoding = errors.New("unsupported encrypted PKCS#8 encoding")
+)
+
+// ExportKey returns the key name of ks encoded in format. The passphrase,
+// only supported by KeyFormatPEMPKCS8, may be nil. The export is recorded in
+// the audit log of an AferoKeystore.
+func ExportKey(ks keystore.Keystore, name, format string, passphrase []byte) ([]byte, error) {
+	k, err := ks.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := MarshalKey(k, format, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if a, ok := ks.(interface{ auditExport(string, ci.PrivKey) }); ok {
+		a.auditExport(name, k)
+	}
+	return data, nil
+}
+
+// ImportKey stores under name in ks the key encoded in format. If a key with
+// the same name already exists, returns ErrKeyExists. The existing key is
+// checked for first, as not every keystore refuses to replace it in Put.
+func ImportKey(ks keystore.Keystore, name string, data []byte, format string, passphrase []byte) error {
+	k, err := UnmarshalKey(data, format, passphrase)
+	if err != nil {
+		return err
+	}
+
+	has, err := ks.Has(name)
+	if err != nil {
+		return err
+	}
+	if has {
+		return keystore.ErrKeyExists
+	}
+	return ks.Put(name, k)
+}
+
+// MarshalKey encodes k in format, see ExportKey.
+func MarshalKey(k ci.PrivKey, format string, passphrase []byte) ([]byte, error) {
+	switch format {
+	case KeyFormatLibp2p:
+		if passphrase != nil {
+			return nil, errors.Errorf("format %s can't be passphrase-protected", format)
+		}
+		return ci.MarshalPrivateKey(k)
+
+	case KeyFormatPEMPKCS8:
+		sk, err := ci.PrivKeyToStdKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := sk.(*ed25519.PrivateKey); ok {
+			sk = *p
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s key", k.Type())
+		}
+
+		block := &pem.Block{Type: pemPrivateKey, Bytes: der}
+		if passphrase != nil {
+			block.Type = pemEncryptedPrivateKey
+			if block.Bytes, err = encryptPKCS8(der, passphrase); err != nil {
+				return nil, err
+			}
+		}
+		return pem.EncodeToMemory(block), nil
+
+	default:
+		return nil, errors.Wrap(ErrUnsupportedKeyFormat, format)
+	}
+}
+
+// UnmarshalKey decodes a key encoded in format, see ImportKey. It returns
+// ErrWrongPassphrase if the key is passphrase-protected and the passphrase is
+// missing or wrong.
+func UnmarshalKey(data []byte, format string, passphrase []byte) (ci.PrivKey, error) {
+	switch format {
+	case KeyFormatLibp2p:
+		return ci.UnmarshalPrivateKey(data)
+
+	case KeyFormatPEMPKCS8:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM block found")
+		}
+
+		der := block.Bytes
+		switch block.Type {
+		case pemPrivateKey:
+		case pemEncryptedPrivateKey:
+			var err error
+			if der, err = decryptPKCS8(der, passphrase); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("unexpected PEM block %q", block.Type)
+		}
+
+		sk, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			if block.Type == pemEncryptedPrivateKey {
+				// the padding was valid by chance
+				return nil, ErrWrongPassphrase
+			}
+			return nil, err
+		}
+		if p, ok := sk.(ed25519.PrivateKey); ok {
+			sk = &p
+		}
+		k, _, err := ci.KeyPairFromStdKey(sk)
+		return k, err
+
+	default:
+		return nil, errors.Wrap(ErrUnsupportedKeyFormat, format)
+	}
+}
+
+// encryptedPrivateKeyInfo is the EncryptedPrivateKeyInfo of RFC 5208.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// encryptPKCS8 encrypts a PKCS#8 key with PBES2, using PBKDF2-SHA256 and
+// AES-256-CBC.
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	// PKCS#7 padding
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+}
+
+// decryptPKCS8 decrypts a PKCS#8 key encrypted by encryptPKCS8, other PBES2
+// schemes are not supported.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.Wrap(ErrWrongPassphrase, "key is passphrase-protected")
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.Wrap(err, "decode encrypted PKCS#8 key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errPKCS8Encoding
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.Wrap(err, "decode PBES2 parameters")
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errPKCS8Encoding
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.Wrap(err, "decode PBKDF2 parameters")
+	}
+	if !kdfParams.PRF.Algorithm.Equal(oidHMACSHA256) {
+		return nil, errPKCS8Encoding
+	}
+	if kdfParams.IterationCount < 1 || kdfParams.IterationCount > maxPBKDF2Iterations {
+		return nil, errors.Errorf("unsupported PBKDF2 iteration count %d", kdfParams.IterationCount)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "decode AES parameters")
+	}
+	data := info.EncryptedData
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errPKCS8Encoding
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, kdfParams.Salt, kdfParams.IterationCount, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	data = append([]byte(nil), data...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || subtle.ConstantTimeCompare(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) != 1 {
+		return nil, ErrWrongPassphrase
+	}
+	return data[:len(data)-pad], nil
+}
@@ -0,0 +1,114 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	ks, err := NewAferoKeystore(fs, "/keystore")
+	require.NoError(t, err)
+
+	ed, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("ed25519", ed))
+	ec, _, err := ci.GenerateECDSAKeyPair(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("ecdsa", ec))
+
+	for _, name := range []string{"ed25519", "ecdsa"} {
+		k, err := ks.Get(name)
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			format     string
+			passphrase []byte
+		}{
+			{KeyFormatLibp2p, nil},
+			{KeyFormatPEMPKCS8, nil},
+			{KeyFormatPEMPKCS8, []byte("pass")},
+		} {
+			data, err := ExportKey(ks, name, tc.format, tc.passphrase)
+			require.NoError(t, err)
+
+			imported := fmt.Sprintf("%s-%s-%t", name, tc.format, tc.passphrase != nil)
+			require.NoError(t, ImportKey(ks, imported, data, tc.format, tc.passphrase))
+			got, err := ks.Get(imported)
+			require.NoError(t, err)
+			require.True(t, k.Equals(got), "%s %s", name, tc.format)
+		}
+	}
+
+	// a cleartext PEM key is readable by other tools
+	data, err := ExportKey(ks, "ed25519", KeyFormatPEMPKCS8, nil)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	_, err = ExportKey(ks, "ed25519", KeyFormatLibp2p, []byte("pass"))
+	require.Error(t, err)
+	_, err = ExportKey(ks, "ed25519", "jwk", nil)
+	require.ErrorIs(t, err, ErrUnsupportedKeyFormat)
+	_, err = ExportKey(ks, "missing", KeyFormatLibp2p, nil)
+	require.ErrorIs(t, err, keystore.ErrNoSuchKey)
+
+	// an existing key is never replaced
+	data, err = ExportKey(ks, "ecdsa", KeyFormatLibp2p, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, ImportKey(ks, "ed25519", data, KeyFormatLibp2p, nil), keystore.ErrKeyExists)
+	got, err := ks.Get("ed25519")
+	require.NoError(t, err)
+	require.True(t, ed.Equals(got))
+}
+
+func TestImportKeyWrongPassphrase(t *testing.T) {
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	data, err := MarshalKey(k, KeyFormatPEMPKCS8, []byte("pass"))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, []byte("-----BEGIN "+pemEncryptedPrivateKey)), "key must be encrypted")
+
+	_, err = UnmarshalKey(data, KeyFormatPEMPKCS8, nil)
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = UnmarshalKey(data, KeyFormatPEMPKCS8, []byte("wrong"))
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+
+	// the work asked by an imported key is bounded
+	block, _ := pem.Decode(data)
+	var info encryptedPrivateKeyInfo
+	_, err = asn1.Unmarshal(block.Bytes, &info)
+	require.NoError(t, err)
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	require.NoError(t, err)
+	var kdfParams pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	require.NoError(t, err)
+	kdfParams.IterationCount = 1 << 30
+	params.KeyDerivationFunc.Parameters.FullBytes, err = asn1.Marshal(kdfParams)
+	require.NoError(t, err)
+	info.Algorithm.Parameters.FullBytes, err = asn1.Marshal(params)
+	require.NoError(t, err)
+	block.Bytes, err = asn1.Marshal(info)
+	require.NoError(t, err)
+	_, err = UnmarshalKey(pem.EncodeToMemory(block), KeyFormatPEMPKCS8, []byte("pass"))
+	require.Error(t, err)
+
+	secp, _, err := ci.GenerateSecp256k1Key(nil)
+	require.NoError(t, err)
+	_, err = MarshalKey(secp, KeyFormatPEMPKCS8, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// keyInfoSuffix is appended to the filename of a key to name the sidecar file
+// holding its metadata.
+const keyInfoSuffix = ".info"
+
+// KeyInfo is the metadata of a key of an AferoKeystore. It is stored in
+// plaintext next to the key, even in an EncryptedAferoKeystore.
+type KeyInfo struct {
+	Name string `json:"-"`
+	// Type is the libp2p type of the key, like "Ed25519". It is empty for
+	// the keys stored before metadata were introduced.
+	Type string `json:",omitempty"`
+	// ID is the peer ID of the key, used as its fingerprint. It is not
+	// stored by an EncryptedAferoKeystore, as it identifies the key.
+	ID string `json:",omitempty"`
+	// Created is the creation time of the key, or the modification time of
+	// the key file when the key has no metadata.
+	Created time.Time
+	Labels  map[string]string `json:",omitempty"`
+}
+
+func isKeyInfoFile(fn string) bool {
+	return strings.HasSuffix(fn, keyInfoSuffix)
+}
+
+func newKeyInfo(k ci.PrivKey) KeyInfo {
+	return KeyInfo{Type: k.Type().String(), ID: keyFingerprint(k), Created: time.Now().UTC()}
+}
+
+// Info returns the metadata of a key, and ErrNoSuchKey if it doesn't exist.
+func (ks *AferoKeystore) Info(name string) (KeyInfo, error) {
+	fn, err := keystoreEncode(name)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	info, err := ks.readInfo(fn)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	info.Name = name
+	return info, nil
+}
+
+// ListWithInfo returns the metadata of all the keys of the Keystore.
+func (ks *AferoKeystore) ListWithInfo() ([]KeyInfo, error) {
+	names, err := ks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]KeyInfo, 0, len(names))
+	for _, name := range names {
+		info, err := ks.Info(name)
+		if err == keystore.ErrNoSuchKey {
+			// deleted since listed
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "key %q", name)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// SetLabels replaces the labels of a key.
+func (ks *AferoKeystore) SetLabels(name string, labels map[string]string) error {
+	fn, err := keystoreEncode(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := ks.readInfo(fn)
+	if err != nil {
+		return err
+	}
+	info.Labels = labels
+	return ks.writeInfo(fn, info)
+}
+
+func (ks *AferoKeystore) readInfo(fn string) (KeyInfo, error) {
+	kp := filepath.Join(ks.dir, fn)
+	buf, err := afero.ReadFile(ks.fs, kp+keyInfoSuffix)
+	if os.IsNotExist(err) {
+		st, err := ks.fs.Stat(kp)
+		if os.IsNotExist(err) {
+			return KeyInfo{}, keystore.ErrNoSuchKey
+		} else if err != nil {
+			return KeyInfo{}, err
+		}
+		return KeyInfo{Created: st.ModTime().UTC()}, nil
+	} else if err != nil {
+		return KeyInfo{}, err
+	}
+
+	var info KeyInfo
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return KeyInfo{}, errors.Wrap(err, "decode key info")
+	}
+	return info, nil
+}
+
+func (ks *AferoKeystore) writeInfo(fn string, info KeyInfo) error {
+	if ks.encrypted {
+		info.ID = ""
+	}
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	f, err := atomicfile.New(ks.fs, filepath.Join(ks.dir, fn+keyInfoSuffix), 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// renameInfo moves the metadata of the key in oldFn to newFn, if any.
+func (ks *AferoKeystore) renameInfo(oldFn, newFn string) error {
+	err := ks.fs.Rename(filepath.Join(ks.dir, oldFn+keyInfoSuffix), filepath.Join(ks.dir, newFn+keyInfoSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeInfo removes the metadata of the key in fn, if any.
+func (ks *AferoKeystore) removeInfo(fn string) error {
+	err := ks.fs.Remove(filepath.Join(ks.dir, fn+keyInfoSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/ipfs/go-ipfs-config"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAferoKeystoreInfo(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	ks, err := NewAferoKeystore(fs, "/keystore")
+	require.NoError(t, err)
+
+	before := time.Now().UTC()
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("self", k))
+
+	info, err := ks.Info("self")
+	require.NoError(t, err)
+	require.Equal(t, "self", info.Name)
+	require.Equal(t, "Ed25519", info.Type)
+	require.False(t, info.Created.Before(before))
+	require.Empty(t, info.Labels)
+
+	require.NoError(t, ks.SetLabels("self", map[string]string{"usage": "ipns"}))
+	_, err = ks.Info("missing")
+	require.ErrorIs(t, err, keystore.ErrNoSuchKey)
+	require.ErrorIs(t, ks.SetLabels("missing", nil), keystore.ErrNoSuchKey)
+
+	// a key stored without metadata
+	legacy, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("legacy", legacy))
+	fn, err := keystoreEncode("legacy")
+	require.NoError(t, err)
+	require.NoError(t, fs.Remove(filepath.Join("/keystore", fn+keyInfoSuffix)))
+
+	names, err := ks.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"self", "legacy"}, names)
+
+	infos, err := ks.ListWithInfo()
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	for _, info := range infos {
+		switch info.Name {
+		case "self":
+			require.Equal(t, map[string]string{"usage": "ipns"}, info.Labels)
+		case "legacy":
+			require.Empty(t, info.Type)
+			require.False(t, info.Created.IsZero())
+		}
+	}
+
+	require.NoError(t, ks.Delete("self"))
+	self, err := keystoreEncode("self")
+	require.NoError(t, err)
+	require.False(t, FileExists(fs, filepath.Join("/keystore", self+keyInfoSuffix)), "metadata must be removed with the key")
+}
+
+func TestAferoKeystoreRename(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	plain, err := NewAferoKeystore(fs, "/plain")
+	require.NoError(t, err)
+	encrypted, err := NewEncryptedAferoKeystore(fs, "/encrypted", testKDFParams)
+	require.NoError(t, err)
+	require.NoError(t, encrypted.Unlock([]byte("pass")))
+
+	for _, ks := range []interface {
+		keystore.Keystore
+		Rename(oldName, newName string) error
+		Info(name string) (KeyInfo, error)
+		SetLabels(name string, labels map[string]string) error
+	}{plain, encrypted} {
+		k, _, err := ci.GenerateEd25519Key(nil)
+		require.NoError(t, err)
+		require.NoError(t, ks.Put("old", k))
+		require.NoError(t, ks.SetLabels("old", map[string]string{"a": "b"}))
+		other, _, err := ci.GenerateEd25519Key(nil)
+		require.NoError(t, err)
+		require.NoError(t, ks.Put("other", other))
+
+		require.ErrorIs(t, ks.Rename("old", "other"), keystore.ErrKeyExists)
+		require.ErrorIs(t, ks.Rename("missing", "new"), keystore.ErrNoSuchKey)
+		require.ErrorIs(t, ks.Rename("old", IdentityKeyName), ErrReservedKeyName)
+
+		require.NoError(t, ks.Rename("old", "new"))
+		has, err := ks.Has("old")
+		require.NoError(t, err)
+		require.False(t, has)
+		got, err := ks.Get("new")
+		require.NoError(t, err)
+		require.True(t, k.Equals(got))
+		info, err := ks.Info("new")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"a": "b"}, info.Labels)
+
+		names, err := ks.List()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"new", "other"}, names)
+	}
+
+	encrypted.Lock()
+	require.ErrorIs(t, encrypted.Rename("new", "renamed"), ErrKeystoreLocked)
+}
+
+func TestAferoKeystoreHalfWritten(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "keystore", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+	dir := filepath.Join(path, "keystore")
+	ks, err := NewAferoKeystore(fs, dir)
+	require.NoError(t, err)
+
+	k, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("self", k))
+	require.ErrorIs(t, ks.Put("self", k), keystore.ErrKeyExists)
+
+	// the leftovers of interrupted writes
+	empty, err := keystoreEncode("empty")
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(dir, empty), nil, 0400))
+	truncated, err := keystoreEncode("truncated")
+	require.NoError(t, err)
+	b, err := ci.MarshalPrivateKey(k)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(dir, truncated), b[:len(b)/2], 0400))
+	temp := filepath.Join(dir, keyTempFilePrefix+"abc123")
+	require.NoError(t, afero.WriteFile(fs, temp, b, 0400))
+
+	names, err := ks.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"self", "truncated"}, names)
+	has, err := ks.Has("empty")
+	require.NoError(t, err)
+	require.False(t, has)
+	for _, name := range []string{"empty", "truncated"} {
+		_, err = ks.Get(name)
+		require.ErrorIs(t, err, ErrCorruptKey, name)
+	}
+
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	kinds := make(map[string]FindingKind)
+	for _, f := range findings {
+		kinds[filepath.Base(f.Path)] = f.Kind
+	}
+	require.Equal(t, map[string]FindingKind{
+		empty:                        FindingKeystoreEntry,
+		truncated:                    FindingKeystoreEntry,
+		keyTempFilePrefix + "abc123": FindingTempFile,
+	}, kinds)
+
+	// a half-written key doesn't block re-creating it
+	require.NoError(t, ks.Put("empty", k))
+	got, err := ks.Get("empty")
+	require.NoError(t, err)
+	require.True(t, k.Equals(got))
+
+	_, err = Repair(fs, path)
+	require.NoError(t, err)
+	require.False(t, FileExists(fs, temp))
+}
@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"sync"
+
+	repo "github.com/ipfs/go-ipfs/repo"
+)
+
+// openRepos tracks the open AferoRepos by path and returns the already open
+// one, like repo.OnlyOne, but the returned repos keep the methods of
+// AferoRepo which are not part of repo.Repo, such as Subscribe.
+type openRepos struct {
+	mu     sync.Mutex
+	active map[string]*repoRef
+}
+
+// Open returns the repo at path, calling open if it is not already open. Call
+// Close on the returned repo when done.
+func (o *openRepos) Open(path string, open func() (*AferoRepo, error)) (repo.Repo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active == nil {
+		o.active = make(map[string]*repoRef)
+	}
+
+	item, found := o.active[path]
+	if !found {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		item = &repoRef{parent: o, path: path, AferoRepo: r}
+		o.active[path] = item
+	}
+	item.refs++
+	return item, nil
+}
+
+type repoRef struct {
+	parent *openRepos
+	path   string
+	refs   uint32
+	*AferoRepo
+}
+
+var _ ConfigSubscriber = (*repoRef)(nil)
+
+// Close closes the repo once all its references are closed.
+func (r *repoRef) Close() error {
+	r.parent.mu.Lock()
+	defer r.parent.mu.Unlock()
+
+	r.refs--
+	if r.refs > 0 {
+		// others are holding it open
+		return nil
+	}
+
+	// last one
+	delete(r.parent.active, r.path)
+	return r.AferoRepo.Close()
+}
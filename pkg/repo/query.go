@@ -0,0 +1,195 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// errStopWalk is used to interrupt a walk once the query is satisfied or closed.
+var errStopWalk = errors.New("stop walk")
+
+// Query streams the entries matching q. The walk starts at the directory of
+// q.Prefix when the datastore is not sharded, and values are only read for
+// entries that pass the key filters.
+func (ads *aferoDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	if ads.isClosed() {
+		return nil, ErrClosed
+	}
+
+	// orders need every entry, so offset and limit must be applied after
+	// sorting instead of during the walk
+	walkQuery := q
+	if len(q.Orders) > 0 {
+		walkQuery.Offset = 0
+		walkQuery.Limit = 0
+	}
+
+	b := dsq.NewResultBuilder(q)
+	b.Process.Go(func(worker goprocess.Process) {
+		ads.walkQuery(worker, b.Output, walkQuery)
+	})
+	go b.Process.CloseAfterChildren() //nolint
+
+	r := b.Results()
+	if len(q.Orders) > 0 {
+		r = dsq.NaiveOrder(r, q.Orders...)
+		if q.Offset != 0 {
+			r = dsq.NaiveOffset(r, q.Offset)
+		}
+		if q.Limit != 0 {
+			r = dsq.NaiveLimit(r, q.Limit)
+		}
+	}
+	return r, nil
+}
+
+func (ads *aferoDatastore) walkQuery(worker goprocess.Process, out chan<- dsq.Result, q dsq.Query) {
+	// append / so a prefix of /bar only finds /bar/baz, not /barbaz
+	prefix := ds.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	// keys sharing a prefix are spread across every shard directory
+	root := ads.path
+	if ads.shard == nil && prefix != "/" {
+		root = filepath.Join(ads.path, filepath.FromSlash(prefix))
+	}
+
+	var keyFilters, valueFilters []dsq.Filter
+	for _, f := range q.Filters {
+		switch f.(type) {
+		case dsq.FilterKeyPrefix, dsq.FilterKeyCompare, *dsq.FilterKeyPrefix, *dsq.FilterKeyCompare:
+			keyFilters = append(keyFilters, f)
+		default:
+			valueFilters = append(valueFilters, f)
+		}
+	}
+
+	skip, sent := q.Offset, 0
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed during the walk
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			if path == filepath.Join(ads.path, journalDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ObjectKeySuffix) {
+			return nil
+		}
+
+		key, ok := ads.filenameKey(path)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		e := dsq.Entry{Key: key, Size: int(info.Size())}
+		if !applyFilters(keyFilters, e) {
+			return nil
+		}
+
+		hasValue := false
+		readValue := func() error {
+			if hasValue || q.KeysOnly {
+				return nil
+			}
+			value, err := afero.ReadFile(ads.fs, path)
+			if err != nil {
+				return err
+			}
+			e.Value, e.Size, hasValue = value, len(value), true
+			return nil
+		}
+
+		if len(valueFilters) > 0 {
+			if err := readValue(); err != nil {
+				return ignoreNotExist(err)
+			}
+			if !applyFilters(valueFilters, e) {
+				return nil
+			}
+		}
+
+		if skip > 0 {
+			skip--
+			return nil
+		}
+
+		if err := readValue(); err != nil {
+			return ignoreNotExist(err)
+		}
+
+		select {
+		case out <- dsq.Result{Entry: e}:
+		case <-worker.Closing():
+			return errStopWalk
+		}
+
+		sent++
+		if q.Limit > 0 && sent >= q.Limit {
+			return errStopWalk
+		}
+		return nil
+	}
+
+	err := afero.Walk(ads.fs, root, walkFn)
+	if err != nil && err != errStopWalk {
+		select {
+		case out <- dsq.Result{Error: err}:
+		case <-worker.Closing():
+		}
+	}
+}
+
+// filenameKey returns the key stored in the given object file.
+func (ads *aferoDatastore) filenameKey(path string) (string, bool) {
+	// remove ds path prefix
+	relPath, err := filepath.Rel(ads.path, path)
+	if err != nil {
+		return "", false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if ads.shard != nil {
+		// remove shard directory
+		i := strings.IndexByte(relPath, '/')
+		if i < 0 {
+			return "", false
+		}
+		relPath = relPath[i+1:]
+	}
+
+	return ds.NewKey(strings.TrimSuffix(relPath, ObjectKeySuffix)).String(), true
+}
+
+func applyFilters(filters []dsq.Filter, e dsq.Entry) bool {
+	for _, f := range filters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,400 @@
+package repo
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/apex/log"
+	humanize "github.com/dustin/go-humanize"
+	ds "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ErrQuotaExceeded is returned by the writes of a quota datastore that would
+// make its usage go over its storage max.
+var ErrQuotaExceeded = errors.New("datastore quota exceeded")
+
+// QuotaEvent is emitted when the usage of a quota datastore crosses its GC
+// watermark.
+type QuotaEvent struct {
+	// Path is the path of the repo the datastore belongs to.
+	Path       string
+	Usage      uint64
+	StorageMax uint64
+	Watermark  uint64
+}
+
+// QuotaHandler is called with the events of every quota datastore.
+type QuotaHandler func(QuotaEvent)
+
+var (
+	quotaHandlersMu sync.Mutex
+	quotaHandlers   = map[int]QuotaHandler{}
+	quotaHandlersID int
+)
+
+// AddQuotaHandler registers a handler notified when a quota datastore crosses
+// its GC watermark, so the embedding application can schedule a GC. The
+// returned function unregisters the handler.
+func AddQuotaHandler(h QuotaHandler) (remove func()) {
+	quotaHandlersMu.Lock()
+	defer quotaHandlersMu.Unlock()
+
+	id := quotaHandlersID
+	quotaHandlersID++
+	quotaHandlers[id] = h
+
+	return func() {
+		quotaHandlersMu.Lock()
+		defer quotaHandlersMu.Unlock()
+		delete(quotaHandlers, id)
+	}
+}
+
+func emitQuotaEvent(evt QuotaEvent) {
+	quotaHandlersMu.Lock()
+	defer quotaHandlersMu.Unlock()
+
+	for _, h := range quotaHandlers {
+		go h(evt)
+	}
+}
+
+type quotaDatastoreConfig struct {
+	child      DatastoreConfig
+	storageMax uint64
+	watermark  uint64
+}
+
+// QuotaDatastoreConfig returns a quota DatastoreConfig from a spec. Its limits
+// are the Datastore.StorageMax and Datastore.StorageGCWatermark of the repo
+// config, applied when the repo opens the datastore.
+func QuotaDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaDatastoreConfig{child: child}, nil
+}
+
+// setQuotaLimits sets the limits of the quota datastores of the datastore tree
+// from the repo config.
+func setQuotaLimits(dsc DatastoreConfig, cfg config.Datastore) error {
+	switch c := dsc.(type) {
+	case *quotaDatastoreConfig:
+		storageMax, err := humanize.ParseBytes(cfg.StorageMax)
+		if err != nil {
+			return errors.Wrap(err, "parse Datastore.StorageMax")
+		}
+
+		// same default as go-ipfs
+		watermark := uint64(90)
+		if cfg.StorageGCWatermark != 0 {
+			watermark = uint64(cfg.StorageGCWatermark)
+		}
+		if cfg.StorageGCWatermark < 0 || watermark > 100 {
+			return fmt.Errorf("Datastore.StorageGCWatermark must be a percentage")
+		}
+
+		c.storageMax = storageMax
+		c.watermark = storageMax * watermark / 100
+		return setQuotaLimits(c.child, cfg)
+	case *mountDatastoreConfig:
+		for _, m := range c.mounts {
+			if err := setQuotaLimits(m.ds, cfg); err != nil {
+				return err
+			}
+		}
+	case *logDatastoreConfig:
+		return setQuotaLimits(c.child, cfg)
+	case *measureDatastoreConfig:
+		return setQuotaLimits(c.child, cfg)
+	case *verifyDatastoreConfig:
+		return setQuotaLimits(c.child, cfg)
+	case *encryptedDatastoreConfig:
+		return setQuotaLimits(c.child, cfg)
+	}
+	return nil
+}
+
+func (c *quotaDatastoreConfig) DiskSpec() DiskSpec {
+	return c.child.DiskSpec()
+}
+
+func (c *quotaDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	if c.storageMax == 0 {
+		return nil, fmt.Errorf("quota datastore has no storage max")
+	}
+
+	child, err := c.child.Create(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &quotaDatastore{
+		Datastore:  child,
+		path:       path,
+		storageMax: c.storageMax,
+		watermark:  c.watermark,
+	}
+	// let the application know right away if a GC is already needed
+	q.checkWatermark()
+
+	if txn, ok := child.(ds.TxnDatastore); ok {
+		return &quotaTxnDatastore{quotaDatastore: q, txn: txn}, nil
+	}
+	return q, nil
+}
+
+// quotaDatastore rejects the writes that would make the disk usage of its child
+// go over storageMax.
+type quotaDatastore struct {
+	repo.Datastore
+	path       string
+	storageMax uint64
+	watermark  uint64
+
+	// mu guards the bytes reserved by the writes in progress and whether
+	// the usage is above the watermark
+	mu       sync.Mutex
+	reserved uint64
+	above    bool
+}
+
+var _ ds.PersistentDatastore = (*quotaDatastore)(nil)
+
+// checkWatermark emits an event when the usage crossed the watermark upward
+// since the last check. The crossings are only reported to the handlers, a
+// failed check is logged.
+func (q *quotaDatastore) checkWatermark() {
+	usage, err := ds.DiskUsage(q.Datastore)
+	if err != nil {
+		log.Errorf("Failed to check the GC watermark of %s: %v", q.path, err)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	above := usage >= q.watermark
+	if above && !q.above {
+		emitQuotaEvent(QuotaEvent{
+			Path:       q.path,
+			Usage:      usage,
+			StorageMax: q.storageMax,
+			Watermark:  q.watermark,
+		})
+	}
+	q.above = above
+}
+
+// sizeDelta returns by how much writing the values of puts grows the usage.
+func (q *quotaDatastore) sizeDelta(puts map[ds.Key]int) (int64, error) {
+	var delta int64
+	for key, size := range puts {
+		oldSize, err := q.Datastore.GetSize(key)
+		if err == ds.ErrNotFound {
+			oldSize = 0
+		} else if err != nil {
+			return 0, err
+		}
+		delta += int64(size - oldSize)
+	}
+	return delta, nil
+}
+
+// reserve fails if writing the values of puts would exceed the quota. The
+// reservation lasts until release is called once the write is done, so
+// concurrent writes can't exceed it together.
+func (q *quotaDatastore) reserve(puts map[ds.Key]int) (release func(), err error) {
+	delta, err := q.sizeDelta(puts)
+	if err != nil {
+		return nil, err
+	}
+	if delta <= 0 {
+		return func() {}, nil
+	}
+	size := uint64(delta)
+
+	usage, err := ds.DiskUsage(q.Datastore)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if usage+q.reserved+size > q.storageMax {
+		return nil, errors.Wrapf(ErrQuotaExceeded, "using %d of %d bytes", usage+q.reserved, q.storageMax)
+	}
+	q.reserved += size
+
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.reserved -= size
+	}, nil
+}
+
+func (q *quotaDatastore) Put(key ds.Key, value []byte) error {
+	release, err := q.reserve(map[ds.Key]int{key: len(value)})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := q.Datastore.Put(key, value); err != nil {
+		return err
+	}
+	q.checkWatermark()
+	return nil
+}
+
+func (q *quotaDatastore) Delete(key ds.Key) error {
+	if err := q.Datastore.Delete(key); err != nil {
+		return err
+	}
+	q.checkWatermark()
+	return nil
+}
+
+func (q *quotaDatastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(q.Datastore)
+}
+
+func (q *quotaDatastore) Batch() (ds.Batch, error) {
+	b, err := q.Datastore.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &quotaBatch{Batch: b, q: q, puts: make(map[ds.Key]int)}, nil
+}
+
+// quotaBatch checks the quota for all its puts on commit.
+type quotaBatch struct {
+	ds.Batch
+	q    *quotaDatastore
+	puts map[ds.Key]int
+}
+
+func (b *quotaBatch) Put(key ds.Key, value []byte) error {
+	if err := b.Batch.Put(key, value); err != nil {
+		return err
+	}
+	b.puts[key] = len(value)
+	return nil
+}
+
+func (b *quotaBatch) Delete(key ds.Key) error {
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	delete(b.puts, key)
+	return nil
+}
+
+func (b *quotaBatch) Commit() error {
+	release, err := b.q.reserve(b.puts)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := b.Batch.Commit(); err != nil {
+		return err
+	}
+	b.q.checkWatermark()
+	return nil
+}
+
+type quotaTxnDatastore struct {
+	*quotaDatastore
+	txn ds.TxnDatastore
+}
+
+var (
+	_ ds.TxnDatastore = (*quotaTxnDatastore)(nil)
+	_ txnBeginner     = (*quotaTxnDatastore)(nil)
+)
+
+func (q *quotaTxnDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	txn, err := q.txn.NewTransaction(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaTxn{Txn: txn, q: q.quotaDatastore, puts: make(map[ds.Key]int)}, nil
+}
+
+func (q *quotaTxnDatastore) txnLocker() sync.Locker {
+	return txnLockerOf(q.txn)
+}
+
+func (q *quotaTxnDatastore) newTransactionLocked(readOnly bool) (ds.Txn, error) {
+	txn, err := q.txn.(txnBeginner).newTransactionLocked(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaTxn{Txn: txn, q: q.quotaDatastore, puts: make(map[ds.Key]int)}, nil
+}
+
+// quotaTxn checks the quota for all its puts on commit.
+type quotaTxn struct {
+	ds.Txn
+	q    *quotaDatastore
+	puts map[ds.Key]int
+}
+
+func (t *quotaTxn) Put(key ds.Key, value []byte) error {
+	if err := t.Txn.Put(key, value); err != nil {
+		return err
+	}
+	t.puts[key] = len(value)
+	return nil
+}
+
+func (t *quotaTxn) Delete(key ds.Key) error {
+	if err := t.Txn.Delete(key); err != nil {
+		return err
+	}
+	delete(t.puts, key)
+	return nil
+}
+
+func (t *quotaTxn) Commit() error {
+	release, err := t.q.reserve(t.puts)
+	if err != nil {
+		t.Txn.Discard()
+		return err
+	}
+	defer release()
+
+	if err := t.Txn.Commit(); err != nil {
+		return err
+	}
+	t.q.checkWatermark()
+	return nil
+}
+
+func (t *quotaTxn) prepare() (*preparedTxn, error) {
+	release, err := t.q.reserve(t.puts)
+	if err != nil {
+		t.Txn.Discard()
+		return nil, err
+	}
+	p, err := prepareTxn(t.Txn)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	p.onRelease = append(p.onRelease, release)
+	p.onCommit = append(p.onCommit, t.q.checkWatermark)
+	return p, nil
+}
@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaDatastoreConfig(t *testing.T) {
+	child := map[string]interface{}{"type": "afero", "path": "datastore"}
+
+	dsc, err := AnyDatastoreConfig(map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{"mountpoint": "/", "type": "quota", "child": child},
+		},
+	})
+	require.NoError(t, err)
+	_, err = dsc.Create(afero.NewMemMapFs(), "/repo")
+	require.Error(t, err)
+
+	// the limits are the ones of the repo config
+	require.NoError(t, setQuotaLimits(dsc, config.Datastore{StorageMax: "1KB", StorageGCWatermark: 50}))
+	q := dsc.(*mountDatastoreConfig).mounts[0].ds.(*quotaDatastoreConfig)
+	require.Equal(t, uint64(1000), q.storageMax)
+	require.Equal(t, uint64(500), q.watermark)
+	require.Equal(t, "afero", q.DiskSpec()["type"])
+	_, err = dsc.Create(afero.NewMemMapFs(), "/repo")
+	require.NoError(t, err)
+
+	require.Error(t, setQuotaLimits(dsc, config.Datastore{StorageMax: "much"}))
+	require.Error(t, setQuotaLimits(dsc, config.Datastore{StorageMax: "1KB", StorageGCWatermark: 150}))
+}
+
+func TestQuotaDatastore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/quota-repo/datastore", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	events := make(chan QuotaEvent, 10)
+	remove := AddQuotaHandler(func(evt QuotaEvent) {
+		if evt.Path == "/quota-repo" {
+			events <- evt
+		}
+	})
+	defer remove()
+
+	q := &quotaDatastore{Datastore: d, path: "/quota-repo", storageMax: 10, watermark: 8}
+
+	require.NoError(t, q.Put(ds.NewKey("/a"), []byte("1234")))
+	require.NoError(t, q.Put(ds.NewKey("/b"), []byte("1234")))
+
+	select {
+	case evt := <-events:
+		require.Equal(t, uint64(8), evt.Usage)
+	case <-time.After(time.Second):
+		t.Fatal("expected a watermark event")
+	}
+
+	err = q.Put(ds.NewKey("/c"), []byte("123"))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	b, err := q.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ds.NewKey("/c"), []byte("123")))
+	require.ErrorIs(t, b.Commit(), ErrQuotaExceeded)
+
+	// overwriting only needs room for the growth
+	require.NoError(t, q.Put(ds.NewKey("/b"), []byte("12345")))
+	require.NoError(t, q.Put(ds.NewKey("/b"), []byte("1234")))
+
+	// deleting makes room again
+	require.NoError(t, q.Delete(ds.NewKey("/a")))
+	require.NoError(t, q.Put(ds.NewKey("/c"), []byte("12")))
+}
@@ -0,0 +1,55 @@
+package repo
+
+import (
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	repo "github.com/ipfs/go-ipfs/repo"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ErrReadOnly is returned by the writes to a repo opened with OpenReadOnly,
+// including the writes to its datastore and keystore.
+var ErrReadOnly = errors.New("repo is opened read-only")
+
+// OpenReadOnly opens the repo at repoPath with a shared lock, so it can be
+// inspected by several processes but not while another process writes to it,
+// see OpenOptions.Locker. It can also be opened from a filesystem that can't
+// be written to such as a zip or tar archive.
+func OpenReadOnly(fs afero.Fs, repoPath string) (repo.Repo, error) {
+	return OpenWithOptions(fs, repoPath, OpenOptions{ReadOnly: true})
+}
+
+// isReadOnlyFs returns whether fs was wrapped by OpenReadOnly.
+func isReadOnlyFs(fs afero.Fs) bool {
+	_, ok := fs.(*afero.ReadOnlyFs)
+	return ok
+}
+
+// readOnlyKeystore rejects the writes to the keystore of a read-only repo.
+type readOnlyKeystore struct {
+	keystore.Keystore
+}
+
+func (ks readOnlyKeystore) Put(string, ci.PrivKey) error {
+	return ErrReadOnly
+}
+
+func (ks readOnlyKeystore) Delete(string) error {
+	return ErrReadOnly
+}
+
+// Locked returns whether the keystore is an encrypted keystore still locked.
+func (ks readOnlyKeystore) Locked() bool {
+	eks, ok := ks.Keystore.(*EncryptedAferoKeystore)
+	return ok && eks.Locked()
+}
+
+// Unlock unlocks the keystore if it is encrypted, so its keys can be read.
+func (ks readOnlyKeystore) Unlock(passphrase []byte) error {
+	eks, ok := ks.Keystore.(*EncryptedAferoKeystore)
+	if !ok {
+		return errors.New("keystore is not encrypted")
+	}
+	return eks.Unlock(passphrase)
+}
@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
+)
+
+// snapshotFs returns the size of every file and directory in fs.
+func snapshotFs(t *testing.T, fs afero.Fs) map[string]int64 {
+	files := make(map[string]int64)
+	require.NoError(t, afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[path] = info.Size()
+		return nil
+	}))
+	return files
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "ro", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	key := ds.NewKey("/foo")
+
+	w, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, w.Datastore().Put(key, []byte("bar")))
+
+	// the lock held by the writer prevents read-only opens, unless they
+	// don't lock
+	_, err = OpenReadOnly(fs, path)
+	require.True(t, errors.As(err, new(lockfile.LockedError)), "expected a LockedError, got %v", err)
+	r, err := OpenWithOptions(fs, path, OpenOptions{ReadOnly: true, Locker: lockfile.NopLocker})
+	require.NoError(t, err)
+	value, err := r.Datastore().Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), value)
+	require.NoError(t, r.Close())
+
+	require.NoError(t, w.Close())
+
+	before := snapshotFs(t, fs)
+
+	r, err = OpenReadOnly(fs, path)
+	require.NoError(t, err)
+	// read-only opens share the lock, and exclude the writers
+	other, err := OpenReadOnly(fs, path)
+	require.NoError(t, err)
+	_, err = Open(fs, path)
+	require.True(t, errors.As(err, new(lockfile.LockedError)), "expected a LockedError, got %v", err)
+	require.NoError(t, other.Close())
+
+	value, err = r.Datastore().Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), value)
+
+	d := r.Datastore()
+	require.ErrorIs(t, d.Put(key, []byte("baz")), ErrReadOnly)
+	require.ErrorIs(t, d.Delete(key), ErrReadOnly)
+	// the mount datastore only creates the batches and transactions of its
+	// mounts on write
+	b, err := d.Batch()
+	if err == nil {
+		err = b.Put(key, []byte("baz"))
+	}
+	require.ErrorIs(t, err, ErrReadOnly)
+	txn, err := d.(ds.TxnDatastore).NewTransaction(false)
+	if err == nil {
+		err = txn.Put(key, []byte("baz"))
+	}
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	cfg, err := r.Config()
+	require.NoError(t, err)
+	require.ErrorIs(t, r.SetConfig(cfg), ErrReadOnly)
+	require.ErrorIs(t, r.SetConfigKey("Addresses.API", "/ip4/127.0.0.1/tcp/5001"), ErrReadOnly)
+	require.ErrorIs(t, r.SetAPIAddr(ma.StringCast("/ip4/127.0.0.1/tcp/5001")), ErrReadOnly)
+	require.ErrorIs(t, r.Keystore().Delete("self"), ErrReadOnly)
+
+	require.NoError(t, r.Close())
+
+	require.Equal(t, before, snapshotFs(t, fs), "read-only open modified the repo")
+}
+
+// createRecorderFs records the files created in it.
+type createRecorderFs struct {
+	afero.Fs
+	created []string
+}
+
+func (f *createRecorderFs) Create(name string) (afero.File, error) {
+	f.created = append(f.created, name)
+	return f.Fs.Create(name)
+}
+
+func (f *createRecorderFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&os.O_CREATE != 0 {
+		f.created = append(f.created, name)
+	}
+	return f.Fs.OpenFile(name, flag, perm)
+}
+
+func TestOpenReadOnlyUnwritable(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "ro", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	// only the lock is written
+	rec := &createRecorderFs{Fs: fs}
+	r, err := OpenReadOnly(rec, path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	for _, name := range rec.created {
+		require.Contains(t, name, repoLock)
+	}
+
+	// an archive can't be locked
+	r, err = OpenReadOnly(afero.NewReadOnlyFs(fs), path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+}
@@ -1,11 +1,13 @@
 package repo
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	filestore "github.com/ipfs/go-filestore"
@@ -20,6 +22,7 @@ import (
 	config "github.com/ipfs/go-ipfs-config"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
 	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
 )
 
@@ -32,7 +35,17 @@ type AferoRepo struct {
 	ds       repo.Datastore
 	keystore keystore.Keystore
 	closed   bool
+	readOnly bool
 	lockfile io.Closer
+
+	// identityInKeystore is set when the identity key is stored in the
+	// keystore instead of the config, see MoveIdentityToKeystore.
+	identityInKeystore bool
+
+	// closing is closed by Close, stopping the config subscribers and poller.
+	closing     chan struct{}
+	subscribers map[*configSubscriber]struct{}
+	configHash  [sha256.Size]byte
 }
 
 var _ repo.Repo = (*AferoRepo)(nil)
@@ -60,41 +73,103 @@ var (
 	// The reason for the above is that in standalone mode without the
 	// daemon, `ipfs config` tries to save work by not building the
 	// full IpfsNode, but accessing the Repo directly.
-	onlyOne repo.OnlyOne
+	onlyOne openRepos
 )
 
+// OpenOptions are the options of OpenWithOptions.
+type OpenOptions struct {
+	// ReadOnly opens the repo read-only, see OpenReadOnly.
+	ReadOnly bool
+
+	// Locker takes the repo lock. It defaults to lockfile.ExclusiveLocker, or
+	// to lockfile.SharedLocker for read-only opens, so a repo can be read by
+	// several processes but not while it is opened for writing. Read-only
+	// opens of a repo which can't be written to, such as an archive, don't
+	// lock. Pass lockfile.NopLocker to read a repo opened for writing.
+	Locker lockfile.Locker
+
+	// ConfigPollInterval is the interval at which the config file is checked
+	// for modifications made outside of the repo, by its hash. A modified
+	// config is reloaded if valid, and notified to the subscribers of
+	// ConfigSubscriber.Subscribe. The config is not polled when zero.
+	ConfigPollInterval time.Duration
+}
+
 func Open(fs afero.Fs, repoPath string) (repo.Repo, error) {
-	fn := func() (repo.Repo, error) {
-		return open(fs, repoPath)
+	return OpenWithOptions(fs, repoPath, OpenOptions{})
+}
+
+// OpenWithOptions opens the repo at repoPath like Open, with opts.
+func OpenWithOptions(fs afero.Fs, repoPath string, opts OpenOptions) (repo.Repo, error) {
+	if opts.ReadOnly {
+		r, err := open(fs, repoPath, opts)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if opts.Locker == nil {
+		opts.Locker = lockfile.ExclusiveLocker
+	}
+	fn := func() (*AferoRepo, error) {
+		return open(fs, repoPath, opts)
 	}
 	return onlyOne.Open(repoPath, fn)
 }
 
-func open(fs afero.Fs, repoPath string) (repo.Repo, error) {
+func open(fs afero.Fs, repoPath string, opts OpenOptions) (*AferoRepo, error) {
 	packageLock.Lock()
 	defer packageLock.Unlock()
 
+	// the lock of a read-only repo is still written to fs
+	lockFs := fs
+	if opts.ReadOnly {
+		fs = afero.NewReadOnlyFs(fs)
+	}
+
 	r, err := newAferoRepo(fs, repoPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "instanciate afero repo")
 	}
+	r.readOnly = opts.ReadOnly
 
-	if err := checkInitialized(r.fs, r.path); err != nil {
-		return nil, errors.Wrap(err, "check repo init")
+	// locking would create the missing repo dir
+	if _, err := r.fs.Stat(r.path); os.IsNotExist(err) {
+		return nil, errors.Wrap(checkInitialized(r.fs, r.path), "check repo init")
 	}
 
-	r.lockfile, err = lockfile.Lock(r.fs, r.path, repoLock)
+	if opts.Locker == nil {
+		r.lockfile, err = lockfile.SharedLocker.Lock(lockFs, r.path, repoLock)
+		if unwritable(err) {
+			// no one can write to it
+			r.lockfile, err = lockfile.NopLocker.Lock(lockFs, r.path, repoLock)
+		}
+	} else {
+		r.lockfile, err = opts.Locker.Lock(lockFs, r.path, repoLock)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "lock repo")
 	}
 	keepLocked := false
 	defer func() {
 		// unlock on error, leave it locked on success
-		if !keepLocked {
+		if !keepLocked && r.lockfile != nil {
 			r.lockfile.Close()
 		}
 	}()
 
+	if !r.readOnly {
+		// complete a commit interrupted by a crash
+		if err := atomicfile.Recover(r.fs, r.path); err != nil {
+			return nil, errors.Wrap(err, "recover interrupted commit")
+		}
+	}
+
+	if err := checkInitialized(r.fs, r.path); err != nil {
+		return nil, errors.Wrap(err, "check repo init")
+	}
+
 	ver, err := GetRepoVersion(r.fs, r.path)
 	if err != nil {
 		return nil, errors.Wrap(err, "get repo version")
@@ -108,8 +183,10 @@ func open(fs afero.Fs, repoPath string) (repo.Repo, error) {
 	}
 
 	// check repo path, then check all constituent parts.
-	if err := Writable(r.fs, r.path); err != nil {
-		return nil, errors.Wrap(err, "check if repo is writable")
+	if !r.readOnly {
+		if err := Writable(r.fs, r.path); err != nil {
+			return nil, errors.Wrap(err, "check if repo is writable")
+		}
 	}
 
 	if err := r.openConfig(); err != nil {
@@ -124,6 +201,10 @@ func open(fs afero.Fs, repoPath string) (repo.Repo, error) {
 		return nil, errors.Wrap(err, "open keystore")
 	}
 
+	if err := r.openIdentity(); err != nil {
+		return nil, errors.Wrap(err, "open identity")
+	}
+
 	/*
 		if r.config.Experimental.FilestoreEnabled || r.config.Experimental.UrlstoreEnabled {
 			r.filemgr = filestore.NewFileManager(r.ds, filepath.Dir(r.path))
@@ -132,6 +213,10 @@ func open(fs afero.Fs, repoPath string) (repo.Repo, error) {
 		}
 	*/
 
+	if opts.ConfigPollInterval > 0 {
+		go r.pollConfig(opts.ConfigPollInterval)
+	}
+
 	keepLocked = true
 	return r, nil
 }
@@ -145,12 +230,20 @@ func (r *AferoRepo) Config() (*config.Config, error) {
 		return nil, errors.New("cannot access config, repo not open")
 	}
 
+	if err := r.loadIdentityUnsynced(); err != nil {
+		return nil, errors.Wrap(err, "load identity")
+	}
+
 	return r.config, nil
 }
 
 // BackupConfig creates a backup of the current configuration file using
 // the given prefix for naming.
 func (r *AferoRepo) BackupConfig(prefix string) (string, error) {
+	if r.readOnly {
+		return "", ErrReadOnly
+	}
+
 	temp, err := afero.TempFile(r.fs, r.path, "config-"+prefix)
 	if err != nil {
 		return "", err
@@ -182,6 +275,10 @@ func (r *AferoRepo) SetConfig(updated *config.Config) error {
 	packageLock.Lock()
 	defer packageLock.Unlock()
 
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
 	return r.setConfigUnsynced(updated)
 }
 
@@ -193,6 +290,9 @@ func (r *AferoRepo) SetConfigKey(key string, value interface{}) error {
 	if r.closed {
 		return errors.New("repo is closed")
 	}
+	if r.readOnly {
+		return ErrReadOnly
+	}
 
 	filename, err := config.Filename(r.path)
 	if err != nil {
@@ -204,12 +304,14 @@ func (r *AferoRepo) SetConfigKey(key string, value interface{}) error {
 		return err
 	}
 
-	// Load private key to guard against it being overwritten.
-	// NOTE: this is a temporary measure to secure this field until we move
-	// keys out of the config file.
-	pkval, err := common.MapGetKV(mapconf, config.PrivKeySelector)
-	if err != nil {
-		return err
+	// Load private key to guard against it being overwritten, unless it is
+	// stored in the keystore.
+	var pkval interface{}
+	if !r.identityInKeystore {
+		pkval, err = common.MapGetKV(mapconf, config.PrivKeySelector)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Set the key in the map.
@@ -218,7 +320,9 @@ func (r *AferoRepo) SetConfigKey(key string, value interface{}) error {
 	}
 
 	// replace private key, in case it was overwritten.
-	if err := common.MapSetKV(mapconf, config.PrivKeySelector, pkval); err != nil {
+	if r.identityInKeystore {
+		scrubPrivKey(mapconf)
+	} else if err := common.MapSetKV(mapconf, config.PrivKeySelector, pkval); err != nil {
 		return err
 	}
 
@@ -228,6 +332,9 @@ func (r *AferoRepo) SetConfigKey(key string, value interface{}) error {
 	if err != nil {
 		return err
 	}
+	if r.identityInKeystore && conf.Identity.PeerID != r.config.Identity.PeerID {
+		return ErrConfigIdentityChanged
+	}
 	if err := WriteConfigFile(r.fs, filename, mapconf); err != nil {
 		return err
 	}
@@ -279,6 +386,10 @@ func (r *AferoRepo) FileManager() *filestore.FileManager {
 
 // SetAPIAddr sets the API address in the repo.
 func (r *AferoRepo) SetAPIAddr(addr ma.Multiaddr) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
 	// Create a temp file to write the address, so that we don't leave empty file when the
 	// program crashes after creating the file.
 	f, err := r.fs.Create(filepath.Join(r.path, "."+apiFile+".tmp"))
@@ -336,9 +447,11 @@ func (r *AferoRepo) Close() error {
 		return errors.New("repo is closed")
 	}
 
-	err := r.fs.Remove(filepath.Join(r.path, apiFile))
-	if err != nil && !os.IsNotExist(err) {
-		fmt.Println("error removing api file: ", err)
+	if !r.readOnly {
+		err := r.fs.Remove(filepath.Join(r.path, apiFile))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("error removing api file: ", err)
+		}
 	}
 
 	if err := r.ds.Close(); err != nil {
@@ -354,6 +467,10 @@ func (r *AferoRepo) Close() error {
 	// logging.Configure(logging.Output(os.Stderr))
 
 	r.closed = true
+	close(r.closing)
+	if r.lockfile == nil {
+		return nil
+	}
 	return r.lockfile.Close()
 }
 
@@ -8,6 +8,7 @@ import (
 	"github.com/apex/log"
 	measure "github.com/ipfs/go-ds-measure"
 	config "github.com/ipfs/go-ipfs-config"
+	keystore "github.com/ipfs/go-ipfs-keystore"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
@@ -21,7 +22,7 @@ func newAferoRepo(fs afero.Fs, rpath string) (*AferoRepo, error) {
 		return nil, err
 	}
 
-	return &AferoRepo{fs: fs, path: expPath}, nil
+	return &AferoRepo{fs: fs, path: expPath, closing: make(chan struct{})}, nil
 }
 
 // openConfig returns an error if the config file is not present.
@@ -35,7 +36,7 @@ func (r *AferoRepo) openConfig() error {
 		return errors.Wrap(err, "load config")
 	}
 	r.config = conf
-	return nil
+	return r.stampConfigUnsynced()
 }
 
 // openDatastore returns an error if the config file is not present.
@@ -53,6 +54,9 @@ func (r *AferoRepo) openDatastore() error {
 	if err != nil {
 		return errors.Wrap(err, "get datastore config")
 	}
+	if err := setQuotaLimits(dsc, r.config.Datastore); err != nil {
+		return err
+	}
 	spec := dsc.DiskSpec()
 
 	oldSpec, err := r.readSpec()
@@ -64,7 +68,7 @@ func (r *AferoRepo) openDatastore() error {
 			oldSpec, spec.String())
 	}
 
-	d, err := dsc.Create(r.path)
+	d, err := dsc.Create(r.fs, r.path)
 	if err != nil {
 		return errors.Wrap(err, "create datastore")
 	}
@@ -72,7 +76,7 @@ func (r *AferoRepo) openDatastore() error {
 
 	// Wrap it with metrics gathering
 	prefix := "ipfs.fsrepo.datastore"
-	r.ds = measure.New(prefix, r.ds)
+	r.ds = withTxn(measure.New(prefix, r.ds), r.ds)
 
 	return nil
 }
@@ -91,13 +95,44 @@ func (r *AferoRepo) readSpec() (string, error) {
 
 func (r *AferoRepo) openKeystore() error {
 	ksp := filepath.Join(r.path, "keystore")
-	ks, err := NewAferoKeystore(r.fs, ksp)
-	if err != nil {
-		return err
+
+	// the keystore directory can't be created in a read-only repo
+	ks := &AferoKeystore{dir: ksp, fs: r.fs}
+	if !r.readOnly {
+		var err error
+		if ks, err = NewAferoKeystore(r.fs, ksp); err != nil {
+			return err
+		}
+	}
+
+	var k keystore.Keystore = ks
+	if isEncryptedKeystore(r.fs, ksp) {
+		// unlocked by the application through Keystore()
+		eks, err := newEncryptedKeystore(ks, nil)
+		if err != nil {
+			return err
+		}
+		k = eks
+	}
+
+	if r.readOnly {
+		k = readOnlyKeystore{k}
 	}
+	r.keystore = k
+	return nil
+}
 
-	r.keystore = ks
+// openIdentity detects a repo whose identity key was moved to the keystore.
+func (r *AferoRepo) openIdentity() error {
+	if r.config.Identity.PrivKey != "" {
+		return nil
+	}
 
+	has, err := r.keystore.Has(IdentityKeyName)
+	if err != nil {
+		return err
+	}
+	r.identityInKeystore = has
 	return nil
 }
 
@@ -121,11 +156,29 @@ func (r *AferoRepo) setConfigUnsynced(updated *config.Config) error {
 	for k, v := range m {
 		mapconf[k] = v
 	}
+	if r.identityInKeystore {
+		// the keystore holds the key of the current identity only
+		if updated.Identity.PeerID != r.config.Identity.PeerID {
+			return ErrConfigIdentityChanged
+		}
+		scrubPrivKey(mapconf)
+		if updated.Identity.PrivKey != r.config.Identity.PrivKey {
+			cfg := *updated
+			cfg.Identity.PrivKey = r.config.Identity.PrivKey
+			updated = &cfg
+		}
+	}
 	if err := WriteConfigFile(r.fs, configFilename, mapconf); err != nil {
 		return err
 	}
+	if err := r.stampConfigUnsynced(); err != nil {
+		// the poller will reload the config we wrote
+		log.Warnf("stamp config: %v", err)
+	}
 	// Do not use `*r.config = ...`. This will modify the *shared* config
 	// returned by `r.Config`.
+	old := r.config
 	r.config = updated
+	r.notifyConfigUnsynced(old, updated, false)
 	return nil
 }
@@ -65,8 +65,6 @@ func testFs(t *testing.T, fs afero.Fs, rpath string) {
 		}
 	}()*/
 
-	DsFs = fs
-
 	initialized := IsInitialized(fs, rpath)
 	require.False(t, initialized)
 
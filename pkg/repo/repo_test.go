@@ -2,14 +2,18 @@ package repo
 
 import (
 	"bytes"
+	"errors"
 	"path/filepath"
 	"testing"
 
 	"github.com/ipfs/go-ipfs/thirdparty/assert"
 	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
 
 	datastore "github.com/ipfs/go-datastore"
 	config "github.com/ipfs/go-ipfs-config"
+
+	lockfile "github.com/berty/go-ipfs-repo-afero/pkg/lock"
 )
 
 // swap arg order
@@ -36,6 +40,59 @@ func Remove(fs afero.Fs, repoPath string) error {
 	return fs.RemoveAll(repoPath)
 }
 
+func TestInitInterrupted(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewOsFs()
+	path := testRepoPath(fs, "init", t)
+	defer fs.RemoveAll(path)
+	// the version file can't replace a non-empty directory, interrupting the
+	// commit after the config is written
+	require.NoError(t, fs.MkdirAll(filepath.Join(path, versionFile, "child"), 0755))
+
+	require.Error(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+	require.True(t, FileExists(fs, filepath.Join(path, config.DefaultConfigFile)))
+	_, err := Open(fs, path)
+	require.Error(t, err, "a half-initialized repo must not be opened")
+
+	require.NoError(t, fs.RemoveAll(filepath.Join(path, versionFile)))
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	findings, err := Check(fs, path)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+}
+
+func TestOpenRecoversUnderLock(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "recover", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	// a commit of the config interrupted by a crash
+	cfg, err := afero.ReadFile(fs, filepath.Join(path, config.DefaultConfigFile))
+	require.NoError(t, err)
+	staged := filepath.Join(path, ".config.staged-1")
+	require.NoError(t, afero.WriteFile(fs, staged, cfg, 0600))
+	journal := `{"Files":[{"Staged":".config.staged-1","Name":"config"}]}`
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(path, ".atomicfile-journal"), []byte(journal), 0600))
+
+	// the commit is left to the holder of the lock
+	lk, err := lockfile.ExclusiveLocker.Lock(fs, path, repoLock)
+	require.NoError(t, err)
+	_, err = Open(fs, path)
+	require.True(t, errors.As(err, new(lockfile.LockedError)))
+	require.True(t, FileExists(fs, staged))
+	require.NoError(t, lk.Close())
+
+	r, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.False(t, FileExists(fs, staged))
+}
+
 func TestCanManageReposIndependently(t *testing.T) {
 	t.Parallel()
 
@@ -129,3 +186,63 @@ func TestOpenMoreThanOnceInSameProcess(t *testing.T) {
 	assert.Nil(r1.Close(), t)
 	assert.Nil(r2.Close(), t)
 }
+
+func TestReposOnDifferentFilesystems(t *testing.T) {
+	t.Parallel()
+
+	fsA := afero.NewMemMapFs()
+	fsB := afero.NewMemMapFs()
+
+	path := "/repo"
+	assert.Nil(Init(fsA, path, &config.Config{Datastore: DefaultDatastoreConfig()}), t, "a", "should initialize successfully")
+	assert.Nil(Init(fsB, path, &config.Config{Datastore: DefaultDatastoreConfig()}), t, "b", "should initialize successfully")
+
+	repoA, err := newAferoRepo(fsA, path)
+	assert.Nil(err, t)
+	assert.Nil(repoA.openConfig(), t)
+	assert.Nil(repoA.openDatastore(), t)
+
+	repoB, err := newAferoRepo(fsB, path)
+	assert.Nil(err, t)
+	assert.Nil(repoB.openConfig(), t)
+	assert.Nil(repoB.openDatastore(), t)
+
+	k := datastore.NewKey("/blocks/CIQKEY")
+	assert.Nil(repoA.Datastore().Put(k, []byte("a")), t)
+
+	has, err := repoB.Datastore().Has(k)
+	assert.Nil(err, t)
+	assert.False(has, t, "b should not see the blocks of a")
+
+	assert.Nil(repoA.ds.Close(), t)
+	assert.Nil(repoB.ds.Close(), t)
+}
+
+func TestCreateDatastoreWithoutFs(t *testing.T) {
+	dsc, err := AnyDatastoreConfig(DefaultDatastoreConfig().Spec)
+	require.NoError(t, err)
+	_, err = dsc.Create(nil, "/repo")
+	require.ErrorIs(t, err, ErrNoFs)
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := testRepoPath(fs, "options", t)
+	require.NoError(t, Init(fs, path, &config.Config{Datastore: DefaultDatastoreConfig()}))
+
+	r, err := OpenWithOptions(fs, path, OpenOptions{Locker: lockfile.MutexLocker})
+	require.NoError(t, err)
+	require.False(t, FileExists(fs, filepath.Join(path, repoLock)), "the mutex locker doesn't create a lock file")
+	_, err = lockfile.MutexLocker.Lock(fs, path, repoLock)
+	require.True(t, errors.As(err, new(lockfile.LockedError)))
+
+	// read-only opens take a shared lock by default
+	ro, err := OpenWithOptions(fs, path, OpenOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, ro.Close())
+
+	require.NoError(t, r.Close())
+	lk, err := lockfile.MutexLocker.Lock(fs, path, repoLock)
+	require.NoError(t, err)
+	require.NoError(t, lk.Close())
+}
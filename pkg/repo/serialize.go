@@ -13,20 +13,23 @@ import (
 	"github.com/spf13/afero"
 )
 
-// WriteConfigFile writes the config from `cfg` into `filename`.
+// WriteConfigFile writes the config from `cfg` into `filename`. The file is
+// synced before it replaces the previous config, whose mode is kept.
 func WriteConfigFile(fs afero.Fs, filename string, cfg interface{}) error {
 	err := fs.MkdirAll(filepath.Dir(filename), 0755)
 	if err != nil {
 		return err
 	}
 
-	f, err := atomicfile.New(fs, filename, 0600)
+	f, err := atomicfile.New(fs, filename, 0600, atomicfile.SyncFile(), atomicfile.SyncDir(), atomicfile.PreserveMode())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	return encode(f, cfg)
+	if err := encode(f, cfg); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
 }
 
 // encode configuration with JSON
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Afero version of the sharding functions of https://github.com/ipfs/go-ds-flatfs
+
+const (
+	shardingFn        = "SHARDING"
+	shardFuncPrefix   = "/repo/flatfs/shard/"
+	shardFuncVersion1 = "v1"
+)
+
+// ShardFunc maps the last namespace of a key to the name of the directory the
+// key is stored in.
+type ShardFunc func(string) string
+
+// ShardIdV1 identifies a flatfs compatible shard function.
+type ShardIdV1 struct {
+	funName string
+	param   int
+	fun     ShardFunc
+}
+
+// String returns the flatfs identifier of the shard function, e.g.
+// "/repo/flatfs/shard/v1/next-to-last/2".
+func (f *ShardIdV1) String() string {
+	return fmt.Sprintf("%s%s/%s/%d", shardFuncPrefix, shardFuncVersion1, f.funName, f.param)
+}
+
+// Func returns the shard function.
+func (f *ShardIdV1) Func() ShardFunc {
+	return f.fun
+}
+
+// ShardPrefix shards keys by their first prefixLen characters.
+func ShardPrefix(prefixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", prefixLen)
+	return &ShardIdV1{
+		funName: "prefix",
+		param:   prefixLen,
+		fun: func(noslash string) string {
+			return (noslash + padding)[:prefixLen]
+		},
+	}
+}
+
+// ShardSuffix shards keys by their last suffixLen characters.
+func ShardSuffix(suffixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", suffixLen)
+	return &ShardIdV1{
+		funName: "suffix",
+		param:   suffixLen,
+		fun: func(noslash string) string {
+			str := padding + noslash
+			return str[len(str)-suffixLen:]
+		},
+	}
+}
+
+// ShardNextToLast shards keys by the suffixLen characters preceding their last
+// character.
+func ShardNextToLast(suffixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", suffixLen+1)
+	return &ShardIdV1{
+		funName: "next-to-last",
+		param:   suffixLen,
+		fun: func(noslash string) string {
+			str := padding + noslash
+			offset := len(str) - suffixLen - 1
+			return str[offset : offset+suffixLen]
+		},
+	}
+}
+
+// ParseShardFunc parses a flatfs shard function identifier.
+func ParseShardFunc(str string) (*ShardIdV1, error) {
+	str = strings.TrimSpace(str)
+
+	if len(str) == 0 {
+		return nil, fmt.Errorf("empty shard identifier")
+	}
+
+	trimmed := strings.TrimPrefix(str, shardFuncPrefix)
+	if str == trimmed { // nothing trimmed
+		return nil, fmt.Errorf("invalid or no prefix in shard identifier: %s", str)
+	}
+	str = trimmed
+
+	parts := strings.Split(str, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid shard identifier: %s", str)
+	}
+
+	version := parts[0]
+	if version != shardFuncVersion1 {
+		return nil, fmt.Errorf("expected 'v1' for version string got: %s", version)
+	}
+
+	funName := parts[1]
+
+	param, err := strconv.Atoi(parts[2])
+	if err != nil || param < 1 {
+		return nil, fmt.Errorf("invalid parameter: %v", parts[2])
+	}
+
+	switch funName {
+	case "prefix":
+		return ShardPrefix(param), nil
+	case "suffix":
+		return ShardSuffix(param), nil
+	case "next-to-last":
+		return ShardNextToLast(param), nil
+	default:
+		return nil, fmt.Errorf("expected 'prefix', 'suffix' or 'next-to-last' got: %s", funName)
+	}
+}
+
+// readShardFunc reads the shard function persisted in the datastore directory,
+// it returns nil if the directory is not sharded.
+func readShardFunc(fs afero.Fs, dir string) (*ShardIdV1, error) {
+	buf, err := afero.ReadFile(fs, filepath.Join(dir, shardingFn))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseShardFunc(string(buf))
+}
+
+// writeShardFunc persists the shard function in the datastore directory.
+func writeShardFunc(fs afero.Fs, dir string, id *ShardIdV1) error {
+	return afero.WriteFile(fs, filepath.Join(dir, shardingFn), []byte(id.String()+"\n"), 0644)
+}
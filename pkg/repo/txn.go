@@ -0,0 +1,756 @@
+package repo
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrTxnConflict = errors.New("transaction conflicts with a concurrent write")
+	ErrTxnReadOnly = errors.New("transaction is read-only")
+	ErrTxnDone     = errors.New("transaction was already committed or discarded")
+)
+
+// txnTracker keeps the previous values of the keys written while
+// transactions are running, so they keep reading the values they started
+// with, and can detect the writes that happened after they began.
+type txnTracker struct {
+	mu      sync.Mutex
+	version uint64
+	// starts counts the running transactions by start version
+	starts map[uint64]int
+	// undo holds the successive previous values of the written keys, in
+	// version order
+	undo map[ds.Key][]undoEntry
+}
+
+// undoEntry is the value a key had before the write of the given version.
+type undoEntry struct {
+	version uint64
+	value   []byte
+	exists  bool
+}
+
+// begin returns the version a new transaction starts at. No write may be in
+// progress.
+func (t *txnTracker) begin() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.starts == nil {
+		t.starts = make(map[uint64]int)
+		t.undo = make(map[ds.Key][]undoEntry)
+	}
+	t.starts[t.version]++
+	return t.version
+}
+
+func (t *txnTracker) end(start uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.starts[start]--
+	if t.starts[start] > 0 {
+		return
+	}
+	delete(t.starts, start)
+	if len(t.starts) == 0 {
+		// nobody reads past values anymore
+		t.starts, t.undo = nil, nil
+		return
+	}
+
+	oldest := ^uint64(0)
+	for s := range t.starts {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	for key, entries := range t.undo {
+		i := 0
+		for i < len(entries) && entries[i].version <= oldest {
+			i++
+		}
+		if i == len(entries) {
+			delete(t.undo, key)
+		} else {
+			t.undo[key] = entries[i:]
+		}
+	}
+}
+
+// record is called before writing key, old returns its current value.
+func (t *txnTracker) record(key ds.Key, old func() ([]byte, bool, error)) error {
+	t.mu.Lock()
+	running := len(t.starts) > 0
+	t.mu.Unlock()
+	if !running {
+		return nil
+	}
+
+	value, exists, err := old()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.starts) == 0 {
+		return nil
+	}
+	t.version++
+	t.undo[key] = append(t.undo[key], undoEntry{version: t.version, value: value, exists: exists})
+	return nil
+}
+
+// snapshot returns the value key had at version, if it was written since.
+func (t *txnTracker) snapshot(key ds.Key, version uint64) (undoEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, e := range t.undo[key] {
+		if e.version > version {
+			return e, true
+		}
+	}
+	return undoEntry{}, false
+}
+
+// snapshots returns the values the keys written since version had then.
+func (t *txnTracker) snapshots(version uint64) map[ds.Key]undoEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snaps := make(map[ds.Key]undoEntry)
+	for key := range t.undo {
+		for _, e := range t.undo[key] {
+			if e.version > version {
+				snaps[key] = e
+				break
+			}
+		}
+	}
+	return snaps
+}
+
+func (t *txnTracker) changedSince(key ds.Key, version uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := t.undo[key]
+	return len(entries) > 0 && entries[len(entries)-1].version > version
+}
+
+// recordWrite records the current value of key, stored in fn, before it is
+// written.
+func (ads *aferoDatastore) recordWrite(key ds.Key, fn string) error {
+	return ads.txns.record(key, func() ([]byte, bool, error) {
+		value, err := afero.ReadFile(ads.fs, fn)
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return value, err == nil, err
+	})
+}
+
+var _ ds.TxnDatastore = (*aferoDatastore)(nil)
+
+// NewTransaction starts an optimistic transaction. It reads a snapshot of the
+// datastore taken when it began, and Commit fails with ErrTxnConflict if a key
+// read or written by the transaction was written by someone else in the
+// meantime.
+func (ads *aferoDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	ads.txnLock.Lock()
+	defer ads.txnLock.Unlock()
+	return ads.newTransactionLocked(readOnly)
+}
+
+var _ txnBeginner = (*aferoDatastore)(nil)
+
+func (ads *aferoDatastore) txnLocker() sync.Locker {
+	return &ads.txnLock
+}
+
+func (ads *aferoDatastore) newTransactionLocked(readOnly bool) (ds.Txn, error) {
+	if ads.isClosed() {
+		return nil, ErrClosed
+	}
+	if ads.readOnly && !readOnly {
+		return nil, ErrReadOnly
+	}
+
+	start := ads.txns.begin()
+	return &aferoTxn{
+		ads:      ads,
+		readOnly: readOnly,
+		start:    start,
+		reads:    make(map[ds.Key]struct{}),
+		ops:      make(map[ds.Key]batchOp),
+	}, nil
+}
+
+type aferoTxn struct {
+	ads      *aferoDatastore
+	readOnly bool
+	start    uint64
+	done     bool
+	reads    map[ds.Key]struct{}
+	ops      map[ds.Key]batchOp
+}
+
+var _ ds.Txn = (*aferoTxn)(nil)
+
+// read runs fn against the datastore, and returns the value key had when the
+// transaction began if it was written since.
+func (t *aferoTxn) read(key ds.Key, fn func() error) (*undoEntry, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	// a write records the previous value before replacing it, so fn read
+	// the snapshot value unless an entry is found after it
+	err := fn()
+	t.reads[key] = struct{}{}
+	if e, ok := t.ads.txns.snapshot(key, t.start); ok {
+		return &e, nil
+	}
+	return nil, err
+}
+
+func (t *aferoTxn) Get(key ds.Key) (value []byte, err error) {
+	if op, ok := t.ops[key]; ok && !t.done {
+		if op.delete {
+			return nil, ds.ErrNotFound
+		}
+		return op.value, nil
+	}
+
+	snap, err := t.read(key, func() (err error) {
+		value, err = t.ads.Get(key)
+		return err
+	})
+	if snap == nil {
+		return value, err
+	}
+	if !snap.exists {
+		return nil, ds.ErrNotFound
+	}
+	return snap.value, nil
+}
+
+func (t *aferoTxn) Has(key ds.Key) (exists bool, err error) {
+	if op, ok := t.ops[key]; ok && !t.done {
+		return !op.delete, nil
+	}
+
+	snap, err := t.read(key, func() (err error) {
+		exists, err = t.ads.Has(key)
+		return err
+	})
+	if snap == nil {
+		return exists, err
+	}
+	return snap.exists, nil
+}
+
+func (t *aferoTxn) GetSize(key ds.Key) (size int, err error) {
+	if op, ok := t.ops[key]; ok && !t.done {
+		if op.delete {
+			return -1, ds.ErrNotFound
+		}
+		return len(op.value), nil
+	}
+
+	snap, err := t.read(key, func() (err error) {
+		size, err = t.ads.GetSize(key)
+		return err
+	})
+	if snap == nil {
+		return size, err
+	}
+	if !snap.exists {
+		return -1, ds.ErrNotFound
+	}
+	return len(snap.value), nil
+}
+
+func (t *aferoTxn) Query(q dsq.Query) (dsq.Results, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	res, err := t.ads.Query(dsq.Query{Prefix: q.Prefix, KeysOnly: q.KeysOnly})
+	if err != nil {
+		return nil, err
+	}
+	stored, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	// like in read, the entries of the keys written during the walk are
+	// replaced by the snapshot values
+	snaps := t.ads.txns.snapshots(t.start)
+
+	entries := make([]dsq.Entry, 0, len(stored))
+	for _, e := range stored {
+		key := ds.RawKey(e.Key)
+		if _, ok := t.ops[key]; ok {
+			continue
+		}
+		if _, ok := snaps[key]; ok {
+			continue
+		}
+		t.reads[key] = struct{}{}
+		entries = append(entries, e)
+	}
+
+	prefix := ds.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+	for key, snap := range snaps {
+		if _, ok := t.ops[key]; ok || !snap.exists || !strings.HasPrefix(key.String(), prefix) {
+			continue
+		}
+		t.reads[key] = struct{}{}
+		e := dsq.Entry{Key: key.String(), Size: len(snap.value)}
+		if !q.KeysOnly {
+			e.Value = snap.value
+		}
+		entries = append(entries, e)
+	}
+
+	for key, op := range t.ops {
+		if op.delete {
+			continue
+		}
+		e := dsq.Entry{Key: key.String(), Size: len(op.value)}
+		if !q.KeysOnly {
+			e.Value = op.value
+		}
+		entries = append(entries, e)
+	}
+
+	return dsq.NaiveQueryApply(q, dsq.ResultsWithEntries(q, entries)), nil
+}
+
+func (t *aferoTxn) Put(key ds.Key, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	if err := t.ads.checkKey(key); err != nil {
+		return err
+	}
+
+	t.ops[key] = batchOp{value: value}
+	return nil
+}
+
+func (t *aferoTxn) Delete(key ds.Key) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	if err := t.ads.checkKey(key); err != nil {
+		return err
+	}
+
+	t.ops[key] = batchOp{delete: true}
+	return nil
+}
+
+func (t *aferoTxn) Commit() error {
+	p, err := t.prepare()
+	if err != nil {
+		return err
+	}
+	return commitPrepared([]*preparedTxn{p})
+}
+
+func (t *aferoTxn) Discard() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.ads.txns.end(t.start)
+}
+
+// txnBeginner is implemented by the datastores whose transactions can begin
+// along with the transactions of other datastores, see mountTxnDatastore.
+type txnBeginner interface {
+	// txnLocker returns the lock blocking the writes while transactions
+	// begin, or nil if the transactions of the datastore can't begin along
+	// with others.
+	txnLocker() sync.Locker
+	// newTransactionLocked begins a transaction, the lock of txnLocker must
+	// be held.
+	newTransactionLocked(readOnly bool) (ds.Txn, error)
+}
+
+// txnLockerOf returns the lock of d, see txnBeginner.
+func txnLockerOf(d ds.TxnDatastore) sync.Locker {
+	if b, ok := d.(txnBeginner); ok {
+		return b.txnLocker()
+	}
+	return nil
+}
+
+// preparer is implemented by the transactions which can be committed along
+// with others, see commitPrepared.
+type preparer interface {
+	prepare() (*preparedTxn, error)
+}
+
+// preparedTxn is a transaction whose writes are staged in a journal, not
+// committed yet. Its datastore is locked against the other writes until it is
+// committed or aborted.
+type preparedTxn struct {
+	txn *aferoTxn
+	// dir is the journal, empty when there is nothing to write
+	dir string
+	// onCommit is run once committed, and onRelease once committed or
+	// aborted, for the transaction wrappers
+	onCommit  []func()
+	onRelease []func()
+}
+
+var _ preparer = (*aferoTxn)(nil)
+
+// prepareTxn prepares txn, if it can be committed along with others.
+func prepareTxn(txn ds.Txn) (*preparedTxn, error) {
+	p, ok := txn.(preparer)
+	if !ok {
+		return nil, errors.New("transaction can't be committed along with others")
+	}
+	return p.prepare()
+}
+
+// prepare checks that the transaction doesn't conflict with the writes made
+// since it began, and stages its writes.
+func (t *aferoTxn) prepare() (*preparedTxn, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	// no other write can happen between the conflict check and the commit
+	t.ads.txnLock.Lock()
+	p := &preparedTxn{txn: t}
+	for key := range t.ops {
+		if t.ads.txns.changedSince(key, t.start) {
+			p.abort()
+			return nil, ErrTxnConflict
+		}
+	}
+	for key := range t.reads {
+		if t.ads.txns.changedSince(key, t.start) {
+			p.abort()
+			return nil, ErrTxnConflict
+		}
+	}
+	if len(t.ops) == 0 {
+		return p, nil
+	}
+	if t.ads.isClosed() {
+		p.abort()
+		return nil, ErrClosed
+	}
+
+	dir, err := t.ads.stageJournal(t.ops)
+	if err != nil {
+		p.abort()
+		return nil, errors.Wrap(err, "stage transaction")
+	}
+	p.dir = dir
+	return p, nil
+}
+
+// abort discards the staged writes and the transaction.
+func (p *preparedTxn) abort() {
+	if p.dir != "" {
+		p.txn.ads.abortJournal(p.dir)
+	}
+	p.release()
+}
+
+func (p *preparedTxn) release() {
+	p.txn.ads.txnLock.Unlock()
+	p.txn.Discard()
+	for _, fn := range p.onRelease {
+		fn()
+	}
+}
+
+// commitPrepared commits the prepared transactions, all of them or none: their
+// journals are committed together with a single marker. If an error is
+// returned once committed, the writes are applied by the next writes or when
+// the datastores are next opened.
+func commitPrepared(ps []*preparedTxn) error {
+	var staged []*preparedTxn
+	for _, p := range ps {
+		if p.dir != "" {
+			staged = append(staged, p)
+		}
+	}
+
+	var err error
+	switch len(staged) {
+	case 0:
+	case 1:
+		err = staged[0].txn.ads.markCommitted(staged[0].dir)
+	default:
+		dss := make([]*aferoDatastore, len(staged))
+		dirs := make([]string, len(staged))
+		for i, p := range staged {
+			dss[i], dirs[i] = p.txn.ads, p.dir
+		}
+		err = commitJournals(dss, dirs)
+	}
+	if err != nil {
+		for _, p := range ps {
+			p.abort()
+		}
+		return errors.Wrap(err, "commit transaction")
+	}
+
+	for _, p := range staged {
+		if perr := p.txn.ads.publishJournal(p.dir); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	for _, p := range ps {
+		p.release()
+		for _, fn := range p.onCommit {
+			fn()
+		}
+	}
+	return err
+}
+
+// txnDatastore adds the transactions of the wrapped child to a datastore, it
+// is used to keep transaction support through the log and measure wrappers.
+type txnDatastore struct {
+	repo.Datastore
+	child ds.TxnDatastore
+}
+
+var (
+	_ ds.TxnDatastore        = (*txnDatastore)(nil)
+	_ ds.PersistentDatastore = (*txnDatastore)(nil)
+	_ txnBeginner            = (*txnDatastore)(nil)
+)
+
+// withTxn returns d with the transaction support of child, if child has any.
+func withTxn(d repo.Datastore, child repo.Datastore) repo.Datastore {
+	txn, ok := child.(ds.TxnDatastore)
+	if !ok {
+		return d
+	}
+	return &txnDatastore{Datastore: d, child: txn}
+}
+
+func (d *txnDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	return d.child.NewTransaction(readOnly)
+}
+
+func (d *txnDatastore) txnLocker() sync.Locker {
+	return txnLockerOf(d.child)
+}
+
+func (d *txnDatastore) newTransactionLocked(readOnly bool) (ds.Txn, error) {
+	return d.child.(txnBeginner).newTransactionLocked(readOnly)
+}
+
+func (d *txnDatastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.Datastore)
+}
+
+// mountTxnDatastore is a mount datastore whose every mount supports
+// transactions. A transaction reads a snapshot of every mount taken when it
+// began, and commits all the mounts or none.
+type mountTxnDatastore struct {
+	*mount.Datastore
+	mounts []mount.Mount
+}
+
+var _ ds.TxnDatastore = (*mountTxnDatastore)(nil)
+
+func (d *mountTxnDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	lockers := make([]sync.Locker, len(d.mounts))
+	for i, m := range d.mounts {
+		lockers[i] = txnLockerOf(m.Datastore.(ds.TxnDatastore))
+		if lockers[i] == nil {
+			return nil, errors.Errorf("transactions of mount %s can't begin along with others", m.Prefix)
+		}
+	}
+
+	// every mount is locked before the first snapshot is taken, so the
+	// snapshots are taken together. The mounts are locked in the same order
+	// as the commits.
+	for _, l := range lockers {
+		l.Lock()
+	}
+	defer func() {
+		for _, l := range lockers {
+			l.Unlock()
+		}
+	}()
+
+	t := &mountTxn{
+		mounts: d.mounts,
+		txns:   make(map[ds.Key]ds.Txn, len(d.mounts)),
+	}
+	for _, m := range d.mounts {
+		txn, err := m.Datastore.(txnBeginner).newTransactionLocked(readOnly)
+		if err != nil {
+			t.Discard()
+			return nil, err
+		}
+		t.txns[m.Prefix] = txn
+	}
+	return t, nil
+}
+
+type mountTxn struct {
+	mounts []mount.Mount
+	txns   map[ds.Key]ds.Txn
+}
+
+var _ ds.Txn = (*mountTxn)(nil)
+
+// lookup returns the transaction of the mount key lives in and the key
+// relative to that mount.
+func (t *mountTxn) lookup(key ds.Key) (ds.Txn, ds.Key, error) {
+	for _, m := range t.mounts {
+		if m.Prefix.IsAncestorOf(key) {
+			return t.txns[m.Prefix], ds.NewKey(strings.TrimPrefix(key.String(), m.Prefix.String())), nil
+		}
+	}
+	return nil, ds.Key{}, mount.ErrNoMount
+}
+
+func (t *mountTxn) Get(key ds.Key) ([]byte, error) {
+	txn, k, err := t.lookup(key)
+	if err == mount.ErrNoMount {
+		return nil, ds.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return txn.Get(k)
+}
+
+func (t *mountTxn) Has(key ds.Key) (bool, error) {
+	txn, k, err := t.lookup(key)
+	if err == mount.ErrNoMount {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return txn.Has(k)
+}
+
+func (t *mountTxn) GetSize(key ds.Key) (int, error) {
+	txn, k, err := t.lookup(key)
+	if err == mount.ErrNoMount {
+		return -1, ds.ErrNotFound
+	} else if err != nil {
+		return -1, err
+	}
+	return txn.GetSize(k)
+}
+
+func (t *mountTxn) Query(q dsq.Query) (dsq.Results, error) {
+	prefix := ds.NewKey(q.Prefix)
+
+	var entries []dsq.Entry
+	for _, m := range t.mounts {
+		var rest ds.Key
+		last := false
+		switch {
+		case m.Prefix.IsDescendantOf(prefix):
+			rest = ds.NewKey("/")
+		case m.Prefix.Equal(prefix) || m.Prefix.IsAncestorOf(prefix):
+			rest = ds.NewKey(strings.TrimPrefix(prefix.String(), m.Prefix.String()))
+			// more general mounts won't contain keys with this prefix
+			last = true
+		default:
+			continue
+		}
+
+		res, err := t.txns[m.Prefix].Query(dsq.Query{Prefix: rest.String(), KeysOnly: q.KeysOnly})
+		if err != nil {
+			return nil, err
+		}
+		es, err := res.Rest()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			e.Key = m.Prefix.Child(ds.RawKey(e.Key)).String()
+			entries = append(entries, e)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	return dsq.NaiveQueryApply(q, dsq.ResultsWithEntries(q, entries)), nil
+}
+
+func (t *mountTxn) Put(key ds.Key, value []byte) error {
+	txn, k, err := t.lookup(key)
+	if err != nil {
+		return err
+	}
+	return txn.Put(k, value)
+}
+
+func (t *mountTxn) Delete(key ds.Key) error {
+	txn, k, err := t.lookup(key)
+	if err == mount.ErrNoMount {
+		return ds.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return txn.Delete(k)
+}
+
+// Commit commits the transactions of every mount together, see
+// commitPrepared.
+func (t *mountTxn) Commit() error {
+	defer t.Discard()
+
+	// prepared in the order of the mounts, so concurrent commits lock the
+	// mounts in the same order
+	ps := make([]*preparedTxn, 0, len(t.mounts))
+	for _, m := range t.mounts {
+		p, err := prepareTxn(t.txns[m.Prefix])
+		if err != nil {
+			for _, p := range ps {
+				p.abort()
+			}
+			return errors.Wrapf(err, "commit mount %s", m.Prefix)
+		}
+		ps = append(ps, p)
+	}
+	return commitPrepared(ps)
+}
+
+func (t *mountTxn) Discard() {
+	for _, txn := range t.txns {
+		txn.Discard()
+	}
+}
@@ -0,0 +1,319 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAferoDatastoreTxn(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/ds", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("a")))
+	require.NoError(t, d.Put(ds.NewKey("/b"), []byte("b")))
+
+	// writes are visible to the transaction only
+	txn, err := d.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(ds.NewKey("/c"), []byte("c")))
+	require.NoError(t, txn.Delete(ds.NewKey("/a")))
+
+	v, err := txn.Get(ds.NewKey("/c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), v)
+	_, err = txn.Get(ds.NewKey("/a"))
+	require.Equal(t, ds.ErrNotFound, err)
+
+	res, err := txn.Query(dsq.Query{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/b", entries[0].Key)
+	require.Equal(t, "/c", entries[1].Key)
+
+	has, err := d.Has(ds.NewKey("/c"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, txn.Commit())
+	require.Equal(t, ErrTxnDone, txn.Put(ds.NewKey("/d"), nil))
+
+	has, err = d.Has(ds.NewKey("/c"))
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = d.Has(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// read-only transactions refuse writes
+	ro, err := d.NewTransaction(true)
+	require.NoError(t, err)
+	require.Equal(t, ErrTxnReadOnly, ro.Put(ds.NewKey("/d"), nil))
+	ro.Discard()
+}
+
+func TestAferoDatastoreTxnConflict(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/ds", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("a")))
+
+	t1, err := d.NewTransaction(false)
+	require.NoError(t, err)
+	t2, err := d.NewTransaction(false)
+	require.NoError(t, err)
+
+	v, err := t1.Get(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.NoError(t, t1.Put(ds.NewKey("/a"), append(v, '1')))
+
+	require.NoError(t, t2.Put(ds.NewKey("/a"), []byte("a2")))
+	require.NoError(t, t2.Commit())
+
+	// t1 read a value which changed since
+	require.Equal(t, ErrTxnConflict, t1.Commit())
+
+	v, err = d.Get(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a2"), v)
+
+	// a read-only transaction conflicts with the writes to the keys it read
+	t3, err := d.NewTransaction(true)
+	require.NoError(t, err)
+	_, err = t3.Get(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("a3")))
+	require.Equal(t, ErrTxnConflict, t3.Commit())
+}
+
+func TestAferoDatastoreTxnSnapshot(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	d, err := newAferoDatastore(fs, "/ds", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("a")))
+	require.NoError(t, d.Put(ds.NewKey("/b"), []byte("b")))
+
+	txn, err := d.NewTransaction(true)
+	require.NoError(t, err)
+
+	// reads never observe writes made after the transaction began
+	require.NoError(t, d.Put(ds.NewKey("/a"), []byte("a2")))
+	require.NoError(t, d.Delete(ds.NewKey("/b")))
+	b, err := d.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ds.NewKey("/c"), []byte("c")))
+	require.NoError(t, b.Put(ds.NewKey("/a"), []byte("a3")))
+	require.NoError(t, b.Commit())
+
+	v, err := txn.Get(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), v)
+	size, err := txn.GetSize(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, 1, size)
+	has, err := txn.Has(ds.NewKey("/b"))
+	require.NoError(t, err)
+	require.True(t, has)
+	_, err = txn.Get(ds.NewKey("/c"))
+	require.Equal(t, ds.ErrNotFound, err)
+
+	// neither the added nor the deleted keys
+	res, err := txn.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/a", entries[0].Key)
+	require.Equal(t, []byte("a"), entries[0].Value)
+	require.Equal(t, "/b", entries[1].Key)
+	require.Equal(t, []byte("b"), entries[1].Value)
+	txn.Discard()
+
+	txn, err = d.NewTransaction(true)
+	require.NoError(t, err)
+	v, err = txn.Get(ds.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a3"), v)
+	txn.Discard()
+	require.Empty(t, d.txns.undo)
+}
+
+func TestMountTxn(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	blocks, err := newAferoDatastore(fs, "/repo/blocks", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	root, err := newAferoDatastore(fs, "/repo/datastore", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+
+	mounts := []mount.Mount{
+		{Prefix: ds.NewKey("/blocks"), Datastore: blocks},
+		{Prefix: ds.NewKey("/"), Datastore: root},
+	}
+	d := &mountTxnDatastore{Datastore: mount.New(mounts), mounts: mounts}
+
+	txn, err := d.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(ds.NewKey("/blocks/x"), []byte("x")))
+	require.NoError(t, txn.Put(ds.NewKey("/pins/y"), []byte("y")))
+
+	res, err := txn.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/blocks/x", entries[0].Key)
+	require.Equal(t, "/pins/y", entries[1].Key)
+
+	require.NoError(t, txn.Commit())
+
+	v, err := blocks.Get(ds.NewKey("/x"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), v)
+	v, err = d.Get(ds.NewKey("/pins/y"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("y"), v)
+}
+
+func TestMountTxnCrash(t *testing.T) {
+	dsc := &aferoDatastoreConfig{sync: true}
+	oldState := map[string]string{"/blocks/x": "old-x", "/y": "old-y", "/z": "old-z"}
+	newState := map[string]string{"/blocks/x": "new-x", "/y": "new-y"}
+
+	open := func(fs afero.Fs, root string) *mountTxnDatastore {
+		t.Helper()
+		blocks, err := newAferoDatastore(fs, filepath.Join(root, "blocks"), dsc)
+		require.NoError(t, err)
+		datastore, err := newAferoDatastore(fs, filepath.Join(root, "datastore"), dsc)
+		require.NoError(t, err)
+		mounts := []mount.Mount{
+			{Prefix: ds.NewKey("/blocks"), Datastore: blocks},
+			{Prefix: ds.NewKey("/"), Datastore: datastore},
+		}
+		return &mountTxnDatastore{Datastore: mount.New(mounts), mounts: mounts}
+	}
+
+	// the repo is reopened from the same path, or from another path after a
+	// move
+	reopens := map[string]func(fs afero.Fs) (afero.Fs, string){
+		"same path": func(fs afero.Fs) (afero.Fs, string) { return fs, "/repo" },
+		"moved":     func(fs afero.Fs) (afero.Fs, string) { return afero.NewBasePathFs(fs, "/repo"), "/" },
+	}
+	for name, reopen := range reopens {
+		t.Run(name, func(t *testing.T) {
+			for budget := 0; ; budget++ {
+				fs := afero.NewMemMapFs()
+				d := open(fs, "/repo")
+				for k, v := range oldState {
+					require.NoError(t, d.Put(ds.NewKey(k), []byte(v)))
+				}
+
+				txn, err := open(&faultFs{Fs: fs, budget: budget}, "/repo").NewTransaction(false)
+				require.NoError(t, err)
+				require.NoError(t, txn.Put(ds.NewKey("/blocks/x"), []byte("new-x")))
+				require.NoError(t, txn.Put(ds.NewKey("/y"), []byte("new-y")))
+				require.NoError(t, txn.Delete(ds.NewKey("/z")))
+				commitErr := txn.Commit()
+
+				// reopen as after a restart
+				rfs, root := reopen(fs)
+				d = open(rfs, root)
+				state := make(map[string]string)
+				for k := range oldState {
+					v, err := d.Get(ds.NewKey(k))
+					if err == ds.ErrNotFound {
+						continue
+					}
+					require.NoError(t, err)
+					state[k] = string(v)
+				}
+				for _, path := range []string{"/repo/blocks", "/repo/datastore"} {
+					journals, err := afero.ReadDir(fs, filepath.Join(path, journalDir))
+					if !os.IsNotExist(err) {
+						require.NoError(t, err)
+					}
+					require.Empty(t, journals, "budget %d", budget)
+				}
+
+				if commitErr == nil {
+					require.Equal(t, newState, state)
+					return
+				}
+				require.ErrorIs(t, commitErr, errFault)
+				require.True(t, reflect.DeepEqual(oldState, state) || reflect.DeepEqual(newState, state),
+					"budget %d: transaction partially applied: %v", budget, state)
+			}
+		})
+	}
+}
+
+// beginHookDatastore runs hook before beginning its transactions.
+type beginHookDatastore struct {
+	*aferoDatastore
+	hook func()
+}
+
+func (d *beginHookDatastore) newTransactionLocked(readOnly bool) (ds.Txn, error) {
+	d.hook()
+	return d.aferoDatastore.newTransactionLocked(readOnly)
+}
+
+func TestMountTxnSnapshot(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	blocks, err := newAferoDatastore(fs, "/repo/blocks", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	root, err := newAferoDatastore(fs, "/repo/datastore", &aferoDatastoreConfig{})
+	require.NoError(t, err)
+	hooked := &beginHookDatastore{aferoDatastore: root}
+	mounts := []mount.Mount{
+		{Prefix: ds.NewKey("/blocks"), Datastore: blocks},
+		{Prefix: ds.NewKey("/"), Datastore: hooked},
+	}
+	d := &mountTxnDatastore{Datastore: mount.New(mounts), mounts: mounts}
+	require.NoError(t, d.Put(ds.NewKey("/blocks/x"), []byte("old-x")))
+	require.NoError(t, d.Put(ds.NewKey("/y"), []byte("old-y")))
+
+	// a commit to both mounts while the transaction begins
+	committed := make(chan error, 1)
+	hooked.hook = func() {
+		hooked.hook = func() {}
+		go func() {
+			txn, err := d.NewTransaction(false)
+			if err == nil {
+				txn.Put(ds.NewKey("/blocks/x"), []byte("new-x"))
+				txn.Put(ds.NewKey("/y"), []byte("new-y"))
+				err = txn.Commit()
+			}
+			committed <- err
+		}()
+		select {
+		case err := <-committed:
+			committed <- err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	txn, err := d.NewTransaction(true)
+	require.NoError(t, err)
+	require.NoError(t, <-committed)
+
+	x, err := txn.Get(ds.NewKey("/blocks/x"))
+	require.NoError(t, err)
+	y, err := txn.Get(ds.NewKey("/y"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"old-x", "old-y"}, []string{string(x), string(y)})
+	txn.Discard()
+}
@@ -14,3 +14,33 @@ func FileExists(fs afero.Fs, filename string) bool {
 	}
 	return false
 }
+
+// isEmptyDir returns whether dir is missing or has no entries.
+func isEmptyDir(fs afero.Fs, dir string) (bool, error) {
+	exists, err := afero.DirExists(fs, dir)
+	if err != nil || !exists {
+		return !exists, err
+	}
+	return afero.IsEmpty(fs, dir)
+}
+
+// writeFile writes data to filename, flushing it to disk if sync is set.
+func writeFile(fs afero.Fs, filename string, data []byte, sync bool) error {
+	f, err := fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
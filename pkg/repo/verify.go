@@ -0,0 +1,173 @@
+package repo
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/ipfs/go-ipfs/repo"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/berty/go-ipfs-repo-afero/pkg/atomicfile"
+)
+
+// CorruptDir is the directory of the repo where the corrupted blocks are
+// moved when quarantine is enabled.
+const CorruptDir = "corrupt"
+
+// CorruptBlockError is returned by the Get of a verify datastore when the
+// value doesn't hash to the multihash encoded in its key.
+type CorruptBlockError struct {
+	Key      ds.Key
+	Expected mh.Multihash
+	Actual   mh.Multihash
+	// Quarantined is the file the block was moved to, if any.
+	Quarantined string
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf("block %s is corrupted: expected hash %s, got %s", e.Key, e.Expected.B58String(), e.Actual.B58String())
+}
+
+type verifyDatastoreConfig struct {
+	child      DatastoreConfig
+	quarantine bool
+}
+
+// VerifyDatastoreConfig returns a verify DatastoreConfig from a spec. A verify
+// datastore checks that the blocks read from its child hash to their key. It
+// is not registered by default, enable it with
+// AddDatastoreConfigHandler("verify", VerifyDatastoreConfig).
+func VerifyDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+
+	var quarantine bool
+	if qv, ok := params["quarantine"]; ok {
+		quarantine, ok = qv.(bool)
+		if !ok {
+			return nil, fmt.Errorf("'quarantine' field is not a boolean")
+		}
+	}
+
+	return &verifyDatastoreConfig{child: child, quarantine: quarantine}, nil
+}
+
+// DiskSpec is the one of the child, verifying doesn't change what is stored.
+func (c *verifyDatastoreConfig) DiskSpec() DiskSpec {
+	return c.child.DiskSpec()
+}
+
+func (c *verifyDatastoreConfig) Create(fs afero.Fs, path string) (repo.Datastore, error) {
+	child, err := c.child.Create(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &verifyDatastore{Datastore: child}
+	if c.quarantine {
+		if fs == nil {
+			fs = DsFs
+		}
+		if fs == nil {
+			return nil, ErrNoFs
+		}
+		v.fs = fs
+		v.quarantine = filepath.Join(path, CorruptDir)
+	}
+	return withTxn(v, child), nil
+}
+
+// verifyDatastore re-hashes the values it reads. Reads done through
+// transactions are not verified.
+type verifyDatastore struct {
+	repo.Datastore
+	fs         afero.Fs
+	quarantine string
+}
+
+var _ ds.PersistentDatastore = (*verifyDatastore)(nil)
+
+func (v *verifyDatastore) Get(key ds.Key) ([]byte, error) {
+	value, err := v.Datastore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := keyMultihash(key)
+	if err != nil {
+		// not a block, nothing to verify
+		return value, nil
+	}
+	prefix, err := mh.Decode(expected)
+	if err != nil {
+		return value, nil
+	}
+
+	actual, err := mh.Sum(value, prefix.Code, prefix.Length)
+	if err != nil {
+		return nil, errors.Wrap(err, "hash block")
+	}
+	if string(actual) == string(expected) {
+		return value, nil
+	}
+
+	cerr := &CorruptBlockError{Key: key, Expected: expected, Actual: actual}
+	if v.quarantine != "" {
+		fn, err := v.quarantineBlock(key, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "quarantine %s", key)
+		}
+		cerr.Quarantined = fn
+	}
+	return nil, cerr
+}
+
+// quarantineBlock moves the block out of the datastore for later inspection.
+func (v *verifyDatastore) quarantineBlock(key ds.Key, value []byte) (string, error) {
+	fn := filepath.Join(v.quarantine, filepath.FromSlash(key.String()))
+	if err := v.fs.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := atomicfile.New(v.fs, fn, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Abort()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	return fn, v.Datastore.Delete(key)
+}
+
+func (v *verifyDatastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(v.Datastore)
+}
+
+// keyMultihash decodes the multihash of a block key, which is either a CID
+// or a multihash.
+func keyMultihash(key ds.Key) (mh.Multihash, error) {
+	buf, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := cid.Cast(buf); err == nil {
+		return c.Hash(), nil
+	}
+	return mh.Cast(buf)
+}
@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDatastore(t *testing.T) {
+	// not registered by default, ignore the error if another test did it
+	_ = AddDatastoreConfigHandler("verify", VerifyDatastoreConfig)
+
+	dsc, err := AnyDatastoreConfig(map[string]interface{}{
+		"type":       "verify",
+		"quarantine": true,
+		"child": map[string]interface{}{
+			"type":      "afero",
+			"path":      "blocks",
+			"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "afero", dsc.DiskSpec()["type"])
+
+	fs := afero.NewMemMapFs()
+	d, err := dsc.Create(fs, "/repo")
+	require.NoError(t, err)
+	_, ok := d.(ds.TxnDatastore)
+	require.True(t, ok, "verify datastore lost transaction support")
+
+	block := []byte("block")
+	h, err := mh.Sum(block, mh.SHA2_256, -1)
+	require.NoError(t, err)
+	key := dshelp.CidToDsKey(cid.NewCidV0(h))
+
+	require.NoError(t, d.Put(key, block))
+	value, err := d.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, block, value)
+
+	// keys which are not blocks are not verified
+	require.NoError(t, d.Put(ds.NewKey("/local/foo"), []byte("bar")))
+	_, err = d.Get(ds.NewKey("/local/foo"))
+	require.NoError(t, err)
+
+	// corrupt the block behind the datastore's back
+	ads, err := newAferoDatastore(fs, "/repo/blocks", dsc.(*verifyDatastoreConfig).child.(*aferoDatastoreConfig))
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, ads.KeyFilename(key), []byte("blocc"), 0644))
+
+	_, err = d.Get(key)
+	var cerr *CorruptBlockError
+	require.True(t, errors.As(err, &cerr), "unexpected error: %v", err)
+	require.Equal(t, key, cerr.Key)
+	require.Equal(t, filepath.Join("/repo", CorruptDir, key.String()), cerr.Quarantined)
+
+	quarantined, err := afero.ReadFile(fs, cerr.Quarantined)
+	require.NoError(t, err)
+	require.Equal(t, []byte("blocc"), quarantined)
+
+	_, err = d.Get(key)
+	require.Equal(t, ds.ErrNotFound, err)
+}